@@ -7,16 +7,29 @@ import (
 )
 
 type Config struct {
-	Port                   string `envconfig:"port" default:"8000"`
-	LineChannelSecret      string `envconfig:"line_channel_secret"`
-	LineChannelToken       string `envconfig:"line_channel_token"`
-	LineNotifyUserID       string `envconfig:"line_notify_user_id"`
-	GameMinPlayers         int    `envconfig:"game_min_players" default:"5"`
-	GameMaxPlayers         int    `envconfig:"game_max_players" default:"10"`
-	GameInitializationTime int    `envconfig:"game_initialization_time" default:"120"`
-	GameVotingTime         int    `envconfig:"game_voting_time" default:"30"`
-	GameVotingRound        int    `envconfig:"game_voting_round" default:"5"`
-	GameMissionTime        int    `envconfig:"game_mission_time" default:"30"`
+	Port                   string   `envconfig:"port" default:"8000"`
+	LineChannelSecret      string   `envconfig:"line_channel_secret"`
+	LineChannelToken       string   `envconfig:"line_channel_token"`
+	LineNotifyUserID       string   `envconfig:"line_notify_user_id"`
+	AdminUserIDs           []string `envconfig:"admin_user_ids"`
+	GameMinPlayers         int      `envconfig:"game_min_players" default:"5"`
+	GameMaxPlayers         int      `envconfig:"game_max_players" default:"10"`
+	GameInitializationTime int      `envconfig:"game_initialization_time" default:"120"`
+	GameLobbyExtensions    int      `envconfig:"game_lobby_extensions" default:"3"`
+	GameVotingTime         int      `envconfig:"game_voting_time" default:"30"`
+	GameVotingRound        int      `envconfig:"game_voting_round" default:"5"`
+	GameMissionTime        int      `envconfig:"game_mission_time" default:"30"`
+	GameAllowMultiple      bool     `envconfig:"game_allow_multiple" default:"false"`
+	TemplateDir            string   `envconfig:"template_dir"`
+	APIAdminToken          string   `envconfig:"api_admin_token"`
+	CompanionBaseURL       string   `envconfig:"companion_base_url"`
+	CompanionSecret        string   `envconfig:"companion_secret"`
+	PostbackSecret         string   `envconfig:"postback_secret"`
+	CheckpointDir          string   `envconfig:"checkpoint_dir" default:"checkpoints"`
+	ShutdownTimeout        int      `envconfig:"shutdown_timeout" default:"20"`
+	HealthTimeout          int      `envconfig:"health_timeout" default:"2"`
+	HealthMaxPending       int      `envconfig:"health_max_pending" default:"200"`
+	LogLevel               string   `envconfig:"log_level" default:"info"`
 }
 
 var conf Config
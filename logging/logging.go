@@ -0,0 +1,165 @@
+// Package logging writes structured logs as JSON lines, one object per
+// entry, with the fields of the logger next to "time", "level" and "msg".
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+var levelNames = map[Level]string{
+	LEVEL_DEBUG: "debug",
+	LEVEL_INFO:  "info",
+	LEVEL_WARN:  "warn",
+	LEVEL_ERROR: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(name, s) {
+			return level, nil
+		}
+	}
+	return LEVEL_INFO, fmt.Errorf("Unknown log level %q", s)
+}
+
+var lock = &sync.Mutex{}
+var output io.Writer = os.Stderr
+var currentLevel = LEVEL_INFO
+
+func SetLevel(l Level) {
+	lock.Lock()
+	defer lock.Unlock()
+	currentLevel = l
+}
+
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	output = w
+}
+
+// Fields are attached to every entry written by a logger.
+type Fields map[string]interface{}
+
+// Logger writes entries with a fixed set of fields. Loggers are immutable:
+// With returns a new one.
+type Logger struct {
+	fields Fields
+}
+
+var root = &Logger{fields: Fields{}}
+
+func With(key string, value interface{}) *Logger {
+	return root.With(key, value)
+}
+
+func WithFields(fields Fields) *Logger {
+	return root.WithFields(fields)
+}
+
+func (l *Logger) With(key string, value interface{}) *Logger {
+	return l.WithFields(Fields{key: value})
+}
+
+func (l *Logger) WithFields(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{fields: merged}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.write(LEVEL_DEBUG, format, args) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.write(LEVEL_INFO, format, args) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.write(LEVEL_WARN, format, args) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.write(LEVEL_ERROR, format, args) }
+
+// Fatalf logs at error level and exits.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.write(LEVEL_ERROR, format, args)
+	os.Exit(1)
+}
+
+func Debugf(format string, args ...interface{}) { root.write(LEVEL_DEBUG, format, args) }
+func Infof(format string, args ...interface{})  { root.write(LEVEL_INFO, format, args) }
+func Warnf(format string, args ...interface{})  { root.write(LEVEL_WARN, format, args) }
+func Errorf(format string, args ...interface{}) { root.write(LEVEL_ERROR, format, args) }
+func Fatalf(format string, args ...interface{}) { root.Fatalf(format, args...) }
+
+func (l *Logger) write(level Level, format string, args []interface{}) {
+	lock.Lock()
+	defer lock.Unlock()
+	if level < currentLevel {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(l.fields)+3)
+	for k, v := range l.fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = fmt.Sprintf(format, args...)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"time":  entry["time"],
+			"level": "error",
+			"msg":   fmt.Sprintf("Cannot encode log entry %q: %s", entry["msg"], err.Error()),
+		})
+	}
+	output.Write(append(data, '\n'))
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l, for FromContext.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the root logger.
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return root
+}
+
+// NewRequestID returns a random ID to correlate the entries of one request.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,24 +1,70 @@
 package main
 
 import (
-	"log"
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/azaky/resistancebot/config"
+	"github.com/azaky/resistancebot/logging"
 	r "github.com/azaky/resistancebot/resistance"
 	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var conf = config.Get()
 
 func main() {
-	lineBot, err := linebot.New(conf.LineChannelSecret, conf.LineChannelToken)
+	level, err := logging.ParseLevel(conf.LogLevel)
 	if err != nil {
-		log.Fatalf("Error when creating line bot: %s", err.Error())
+		logging.Fatalf("Error when parsing log level: %s", err.Error())
 	}
-	rLineBot := r.NewLineBot(lineBot)
+	logging.SetLevel(level)
+	if len(conf.PostbackSecret) == 0 {
+		logging.Warnf("POSTBACK_SECRET is not set, buttons will stop working when the bot restarts")
+	}
+
+	lineBot, err := linebot.New(conf.LineChannelSecret, conf.LineChannelToken,
+		linebot.WithHTTPClient(&http.Client{Transport: &r.RetryAfterTransport{}}))
+	if err != nil {
+		logging.Fatalf("Error when creating line bot: %s", err.Error())
+	}
+	templates, err := r.LoadTemplates(conf.TemplateDir)
+	if err != nil {
+		logging.Fatalf("Error when loading templates: %s", err.Error())
+	}
+	rLineBot := r.NewLineBot(lineBot, templates)
+
+	store, err := r.NewFileStore(conf.CheckpointDir)
+	if err != nil {
+		logging.Fatalf("Error when opening checkpoint store: %s", err.Error())
+	}
+
+	feed := r.NewFeed()
+	rLineBot.Subscribe(feed)
+	rLineBot.Subscribe(r.NewMetrics())
 
 	http.HandleFunc("/line/callback", rLineBot.EventHandler)
+	http.Handle("/ws/games/", feed)
+
+	api := r.NewAPI(conf.APIAdminToken, rLineBot)
+	http.Handle("/api/games", api)
+	http.Handle("/api/games/", api)
+
+	if len(conf.CompanionBaseURL) > 0 && len(conf.CompanionSecret) > 0 {
+		companion := r.NewCompanion(conf.CompanionBaseURL, conf.CompanionSecret)
+		rLineBot.UseCompanion(companion)
+		http.Handle("/play/", companion)
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+
+	health := r.NewHealth(store, rLineBot)
+	http.Handle("/healthz", health)
+	http.Handle("/readyz", health)
 
 	// Setup root endpoint
 	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
@@ -27,7 +73,36 @@ func main() {
 		w.Write([]byte(`{"message":"Hello from resistancebot"}`))
 	})
 
-	if err := http.ListenAndServe(":"+conf.Port, nil); err != nil {
-		log.Fatalf("Error http.ListenAndServe: %s", err.Error())
+	// Pick up the games saved by the previous shutdown
+	if n, err := rLineBot.ResumeGames(store); err != nil {
+		logging.Errorf("Error resuming games: %s", err.Error())
+	} else if n > 0 {
+		logging.Infof("Resumed %d game(s)", n)
+	}
+
+	server := &http.Server{Addr: ":" + conf.Port}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Fatalf("Error http.ListenAndServe: %s", err.Error())
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	logging.Infof("Received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeout)*time.Second)
+	defer cancel()
+	// Stop taking webhooks first, so that no game moves on once it is saved
+	if err := server.Shutdown(ctx); err != nil {
+		logging.Errorf("Error shutting down server: %s", err.Error())
+	}
+	if err := r.Shutdown(ctx, store); err != nil {
+		logging.Errorf("Error saving games: %s", err.Error())
+	}
+	// Let the "your game will resume" messages out
+	if err := rLineBot.Flush(ctx); err != nil {
+		logging.Errorf("Error flushing messages: %s", err.Error())
 	}
 }
@@ -0,0 +1,160 @@
+package resistance
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/azaky/resistancebot/logging"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// Admin commands are sent to the bot by private message, by the user in
+// LineNotifyUserID or in AdminUserIDs. Everyone else is ignored.
+
+const adminUsage = `Admin commands:
+.admin games : List running games
+.admin inspect <id> : Show the state of a game
+.admin abort <id> : Abort a game, or drop it if it's stuck
+.admin broadcast <message> : Send a message to every running game`
+
+func (b *LineBot) isAdmin(userID string) bool {
+	if userID == "" {
+		return false
+	}
+	if userID == conf.LineNotifyUserID {
+		return true
+	}
+	for _, admin := range conf.AdminUserIDs {
+		if userID == admin {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *LineBot) admin(ctx context.Context, event *linebot.Event, args ...string) {
+	if !b.isAdmin(event.Source.UserID) {
+		// don't bother reply
+		return
+	}
+	command, arg := args[1], strings.TrimSpace(args[2])
+	logging.FromContext(ctx).Infof("Admin command %s %s", command, arg)
+
+	switch {
+	case command == "games":
+		b.reply(event, b.adminGames())
+	case command == "inspect" && arg != "":
+		b.reply(event, b.adminInspect(arg))
+	case command == "abort" && arg != "":
+		b.reply(event, b.adminAbort(ctx, arg))
+	case command == "broadcast" && arg != "":
+		b.reply(event, b.adminBroadcast(arg))
+	default:
+		b.reply(event, adminUsage)
+	}
+}
+
+func (b *LineBot) adminGames() string {
+	list := ListGames()
+	if len(list) == 0 {
+		return "No running games"
+	}
+	count := make(map[State]int)
+	var buffer bytes.Buffer
+	for _, game := range list {
+		s := game.Snapshot()
+		count[s.State]++
+		buffer.WriteString(fmt.Sprintf("\n%s: %s, %d players", s.ID, s.State, s.NPlayers))
+		if s.Round > 0 {
+			buffer.WriteString(fmt.Sprintf(", mission #%d", s.Round))
+		}
+	}
+	var counts []string
+	for state := STATE_INITIALIZED; state <= STATE_MISSION; state++ {
+		if count[state] > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", count[state], state))
+		}
+	}
+	return fmt.Sprintf("%d running games (%s):\n%s", len(list), strings.Join(counts, ", "), buffer.String())
+}
+
+// adminInspect shows what everyone in the game can see, plus who has voted
+// or played their card. Roles and cards are never shown, admins may be
+// playing too.
+func (b *LineBot) adminInspect(id string) string {
+	game := LoadGame(id)
+	if game == nil {
+		return fmt.Sprintf("Game %s not found", id)
+	}
+	s := game.Snapshot()
+	view := s.PublicView()
+
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("Game %s: %s", s.ID, s.State))
+	if s.Round > 0 {
+		buffer.WriteString(fmt.Sprintf("\nMission #%d, Leader #%d", s.Round, s.VotingRound))
+	}
+	buffer.WriteString("\n\nPlayers:")
+	for i, player := range view.Players {
+		buffer.WriteString(fmt.Sprintf("\n%d. %s (%s)", i+1, player.Name, s.Players[i].ID))
+		if player.Leader {
+			buffer.WriteString(" [leader]")
+		}
+	}
+	if len(view.Team) > 0 {
+		buffer.WriteString("\n\nTeam: " + strings.Join(publicNames(view.Team), ", "))
+	}
+	if s.State == STATE_VOTING {
+		buffer.WriteString(fmt.Sprintf("\nVoted: %d of %d", len(s.Votes), s.NPlayers))
+	}
+	for _, mission := range view.Missions {
+		buffer.WriteString(fmt.Sprintf("\nMission #%d (%s): ", mission.Round, strings.Join(publicNames(mission.Members), ", ")))
+		switch {
+		case !mission.Done:
+			buffer.WriteString("running")
+		case mission.Success:
+			buffer.WriteString("success")
+		default:
+			buffer.WriteString(fmt.Sprintf("failed with %d fail(s)", mission.NFail))
+		}
+	}
+	return buffer.String()
+}
+
+func (b *LineBot) adminAbort(ctx context.Context, id string) string {
+	game := LoadGame(id)
+	if game == nil {
+		return fmt.Sprintf("Game %s not found", id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	switch err := game.Abort(ctx, "system"); err {
+	case nil:
+		return fmt.Sprintf("Game %s aborted", id)
+	case context.DeadlineExceeded:
+		// The daemon is stuck, let the group start a new game meanwhile
+		game.Kill()
+		b.push(id, b.templates.render("abort", abortMessage{}))
+		return fmt.Sprintf("Game %s did not answer in %s, killed it", id, commandTimeout)
+	default:
+		return fmt.Sprintf("Cannot abort game %s: %s", id, err.Error())
+	}
+}
+
+func (b *LineBot) adminBroadcast(message string) string {
+	list := ListGames()
+	for _, game := range list {
+		b.push(game.ID, message)
+	}
+	return fmt.Sprintf("Message sent to %d games", len(list))
+}
+
+func publicNames(players []PublicPlayer) []string {
+	var names []string
+	for _, player := range players {
+		names = append(names, player.Name)
+	}
+	return names
+}
@@ -0,0 +1,140 @@
+package resistance
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/azaky/resistancebot/logging"
+)
+
+// API serves a JSON view of the running games under /api/games, plus a few
+// admin actions guarded by a bearer token:
+//
+//	GET  /api/games            list games, with their group IDs and players (admin)
+//	GET  /api/games/:id        public state of a game
+//	GET  /api/games/:id/record the last finished game, roles included, see Record (admin)
+//	POST /api/games/:id/abort  abort a game (admin)
+type API struct {
+	adminToken string
+	finished   interface{ LastFinished(id string) *Snapshot }
+}
+
+// NewAPI creates the API. Finished games are looked up in finished, see
+// LineBot.LastFinished.
+func NewAPI(adminToken string, finished interface{ LastFinished(id string) *Snapshot }) *API {
+	return &API{
+		adminToken: adminToken,
+		finished:   finished,
+	}
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/games"), "/")
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+
+	switch {
+	case len(parts) == 0 && req.Method == http.MethodGet:
+		api.listGames(w, req)
+
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		api.getGame(w, req, parts[0])
+
+	case len(parts) == 2 && parts[1] == "record" && req.Method == http.MethodGet:
+		api.getRecord(w, req, parts[0])
+
+	case len(parts) == 2 && parts[1] == "abort" && req.Method == http.MethodPost:
+		api.abortGame(w, req, parts[0])
+
+	default:
+		api.error(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (api *API) listGames(w http.ResponseWriter, req *http.Request) {
+	if !api.authorized(req) {
+		api.error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	views := []*PublicGame{}
+	for _, game := range ListGames() {
+		views = append(views, game.Snapshot().PublicView())
+	}
+	api.json(w, http.StatusOK, views)
+}
+
+func (api *API) getGame(w http.ResponseWriter, req *http.Request, id string) {
+	game := LoadGame(id)
+	if game == nil {
+		api.error(w, http.StatusNotFound, "Game not found")
+		return
+	}
+	api.json(w, http.StatusOK, game.Snapshot().PublicView())
+}
+
+func (api *API) getRecord(w http.ResponseWriter, req *http.Request, id string) {
+	if !api.authorized(req) {
+		api.error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	// Running games are never exported, admins may be playing
+	game := api.finished.LastFinished(id)
+	if game == nil || !game.Over() {
+		api.error(w, http.StatusNotFound, "No finished game")
+		return
+	}
+	record, err := Export(game)
+	if err != nil {
+		api.error(w, http.StatusConflict, err.Error())
+		return
+	}
+	api.json(w, http.StatusOK, record)
+}
+
+func (api *API) abortGame(w http.ResponseWriter, req *http.Request, id string) {
+	if !api.authorized(req) {
+		api.error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	game := LoadGame(id)
+	if game == nil {
+		api.error(w, http.StatusNotFound, "Game not found")
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), commandTimeout)
+	defer cancel()
+	if err := game.Abort(ctx, "system"); err == ErrGameOver {
+		api.error(w, http.StatusNotFound, "Game not found")
+		return
+	} else if err != nil {
+		api.error(w, http.StatusConflict, err.Error())
+		return
+	}
+	api.json(w, http.StatusOK, map[string]string{"message": "Game aborted"})
+}
+
+func (api *API) authorized(req *http.Request) bool {
+	if api.adminToken == "" {
+		// Admin actions are disabled without a token
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) == 1
+}
+
+func (api *API) json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.With("component", "api").Errorf("Error encoding response: %s", err.Error())
+	}
+}
+
+func (api *API) error(w http.ResponseWriter, status int, message string) {
+	api.json(w, status, map[string]string{"message": message})
+}
@@ -0,0 +1,102 @@
+package resistance
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeFinished map[string]*Snapshot
+
+func (f fakeFinished) LastFinished(id string) *Snapshot {
+	return f[id]
+}
+
+func TestAPIRecord(t *testing.T) {
+	rec := newRecorder()
+	finished := playToEnd(t, newTestGame(t, "test-api-finished", 5, rec), rec)
+	game := newTestGame(t, "test-api", 5, newRecorder())
+	defer game.Abort(ctx, "system")
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	api := NewAPI("secret", fakeFinished{
+		"test-api-finished": finished,
+		"running":           game.Snapshot(),
+	})
+
+	get := func(id, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/games/"+id+"/record", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("test-api-finished", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("record without token returned %d", w.Code)
+	}
+	if w := get("test-api-finished", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("record with a wrong token returned %d", w.Code)
+	}
+	// Running games stay hidden, even when asked by their ID
+	for _, id := range []string{"test-api", "running"} {
+		if w := get(id, "secret"); w.Code != http.StatusNotFound {
+			t.Errorf("record of running game %s returned %d", id, w.Code)
+		}
+	}
+
+	w := get("test-api-finished", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("record of a finished game returned %d: %s", w.Code, w.Body.String())
+	}
+	var record Record
+	if err := json.NewDecoder(w.Body).Decode(&record); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if record.ID != "test-api-finished" || record.Winner != "resistance" || len(record.Missions) != 3 {
+		t.Errorf("record is %+v", record)
+	}
+	data, _ := json.Marshal(record)
+	if _, err := Import(data); err != nil {
+		t.Errorf("Import of the exported record: %s", err)
+	}
+}
+
+func TestAPIListGames(t *testing.T) {
+	game := newTestGame(t, "test-api-list", 5, newRecorder())
+	defer game.Abort(ctx, "system")
+	api := NewAPI("secret", fakeFinished{})
+
+	list := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/games", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := list(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("list without token returned %d", w.Code)
+	}
+	w := list("secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list returned %d: %s", w.Code, w.Body.String())
+	}
+	var views []*PublicGame
+	if err := json.NewDecoder(w.Body).Decode(&views); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	found := false
+	for _, view := range views {
+		found = found || view.ID == "test-api-list"
+	}
+	if !found {
+		t.Errorf("test-api-list is not listed")
+	}
+}
@@ -0,0 +1,326 @@
+package resistance
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/azaky/resistancebot/logging"
+)
+
+// Checkpoint is the saved state of a game, written when the bot shuts down
+// and read back when it boots, see Shutdown and Resume. Roles are saved too,
+// so checkpoints must be kept private.
+type Checkpoint struct {
+	ID                string               `json:"id"`
+	State             State                `json:"state"`
+	Players           []checkpointPlayer   `json:"players"`
+	Round             int                  `json:"round"`
+	VotingRound       int                  `json:"voting_round"`
+	LeaderIndex       int                  `json:"leader_index"`
+	Picks             []string             `json:"picks,omitempty"`
+	Votes             map[string]bool      `json:"votes,omitempty"`
+	Missions          []checkpointMission  `json:"missions"`
+	Proposals         []checkpointProposal `json:"proposals,omitempty"`
+	Unconfirmed       []string             `json:"unconfirmed,omitempty"`
+	KeepSeating       bool                 `json:"keep_seating,omitempty"`
+	Ready             []string             `json:"ready,omitempty"`
+	Extensions        int                  `json:"extensions,omitempty"`
+	SpyWonByRejection bool                 `json:"spy_won_by_rejection,omitempty"`
+	Phase             int                  `json:"phase"`
+	Nonce             string               `json:"nonce,omitempty"`
+	SavedAt           time.Time            `json:"saved_at"`
+}
+
+type checkpointPlayer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Spy  bool   `json:"spy,omitempty"`
+}
+
+type checkpointMission struct {
+	Round   int             `json:"round"`
+	Members []string        `json:"members"`
+	Success bool            `json:"success"`
+	Votes   map[string]bool `json:"votes"`
+	MinFail int             `json:"min_fail"`
+}
+
+type checkpointProposal struct {
+	Round       int             `json:"round"`
+	VotingRound int             `json:"voting_round"`
+	Leader      string          `json:"leader"`
+	Team        []string        `json:"team"`
+	Votes       map[string]bool `json:"votes"`
+	Approved    bool            `json:"approved"`
+}
+
+func newCheckpoint(s *Snapshot) *Checkpoint {
+	c := &Checkpoint{
+		ID:                s.ID,
+		State:             s.State,
+		Round:             s.Round,
+		VotingRound:       s.VotingRound,
+		LeaderIndex:       s.LeaderIndex,
+		Votes:             s.Votes,
+		Missions:          []checkpointMission{},
+		SpyWonByRejection: s.spyWonByRejection,
+		KeepSeating:       s.KeepSeating,
+		Extensions:        s.Extensions,
+		Phase:             s.Phase,
+		Nonce:             s.nonce,
+		SavedAt:           time.Now(),
+	}
+	for _, player := range s.Players {
+		c.Players = append(c.Players, checkpointPlayer{
+			ID:   player.ID,
+			Name: player.Name,
+			Spy:  player.Role == ROLE_SPY,
+		})
+	}
+	for _, pick := range s.GetPicks() {
+		c.Picks = append(c.Picks, pick.ID)
+	}
+	for _, player := range s.Players {
+		if s.Unconfirmed[player.ID] {
+			c.Unconfirmed = append(c.Unconfirmed, player.ID)
+		}
+		if s.Ready[player.ID] {
+			c.Ready = append(c.Ready, player.ID)
+		}
+	}
+	for _, mission := range s.Missions {
+		m := checkpointMission{
+			Round:   mission.Round,
+			Success: mission.Success,
+			Votes:   mission.Votes,
+			MinFail: mission.MinFail,
+		}
+		for _, member := range mission.Members {
+			m.Members = append(m.Members, member.ID)
+		}
+		c.Missions = append(c.Missions, m)
+	}
+	for _, proposal := range s.Proposals {
+		p := checkpointProposal{
+			Round:       proposal.Round,
+			VotingRound: proposal.VotingRound,
+			Leader:      proposal.Leader.ID,
+			Votes:       proposal.Votes,
+			Approved:    proposal.Approved,
+		}
+		for _, member := range proposal.Team {
+			p.Team = append(p.Team, member.ID)
+		}
+		c.Proposals = append(c.Proposals, p)
+	}
+	return c
+}
+
+// snapshot rebuilds the state of the game from the checkpoint.
+func (c *Checkpoint) snapshot() (*Snapshot, error) {
+	s := &Snapshot{
+		ID:                c.ID,
+		Players:           []*Player{},
+		NPlayers:          len(c.Players),
+		State:             c.State,
+		Round:             c.Round,
+		VotingRound:       c.VotingRound,
+		LeaderIndex:       c.LeaderIndex,
+		Picks:             make(map[string]*Player),
+		Votes:             make(map[string]bool),
+		Missions:          []*Mission{},
+		Proposals:         []*Proposal{},
+		KeepSeating:       c.KeepSeating,
+		Extensions:        c.Extensions,
+		Phase:             c.Phase,
+		spyWonByRejection: c.SpyWonByRejection,
+		nonce:             c.Nonce,
+	}
+	if s.nonce == "" {
+		s.nonce = newNonce()
+	}
+	for _, player := range c.Players {
+		role := ROLE_RESISTANCE
+		if player.Spy {
+			role = ROLE_SPY
+		}
+		s.Players = append(s.Players, &Player{ID: player.ID, Name: player.Name, Role: role})
+	}
+	find := func(id string) (*Player, error) {
+		if player := s.FindPlayerByID(id); player != nil {
+			return player, nil
+		}
+		return nil, fmt.Errorf("Unknown player %s in checkpoint of game %s", id, c.ID)
+	}
+
+	if s.State != STATE_INITIALIZED {
+		config, ok := gameConfigMap[s.NPlayers]
+		if !ok {
+			return nil, fmt.Errorf("No config for %d players in checkpoint of game %s", s.NPlayers, c.ID)
+		}
+		s.Config = config
+		if s.LeaderIndex < 0 || s.LeaderIndex >= s.NPlayers {
+			return nil, fmt.Errorf("Invalid leader in checkpoint of game %s", c.ID)
+		}
+	}
+	for _, id := range c.Picks {
+		player, err := find(id)
+		if err != nil {
+			return nil, err
+		}
+		s.Picks[id] = player
+	}
+	for id, vote := range c.Votes {
+		if _, err := find(id); err != nil {
+			return nil, err
+		}
+		s.Votes[id] = vote
+	}
+	if len(c.Ready) > 0 {
+		s.Ready = make(map[string]bool)
+		for _, id := range c.Ready {
+			if _, err := find(id); err != nil {
+				return nil, err
+			}
+			s.Ready[id] = true
+		}
+	}
+	if len(c.Unconfirmed) > 0 {
+		s.Unconfirmed = make(map[string]bool)
+		for _, id := range c.Unconfirmed {
+			if _, err := find(id); err != nil {
+				return nil, err
+			}
+			s.Unconfirmed[id] = true
+		}
+	}
+	for _, mission := range c.Missions {
+		m := &Mission{
+			Round:   mission.Round,
+			Success: mission.Success,
+			Votes:   make(map[string]bool),
+			MinFail: mission.MinFail,
+		}
+		for _, id := range mission.Members {
+			player, err := find(id)
+			if err != nil {
+				return nil, err
+			}
+			m.Members = append(m.Members, player)
+		}
+		for id, vote := range mission.Votes {
+			m.Votes[id] = vote
+		}
+		s.Missions = append(s.Missions, m)
+	}
+	for _, proposal := range c.Proposals {
+		leader, err := find(proposal.Leader)
+		if err != nil {
+			return nil, err
+		}
+		p := &Proposal{
+			Round:       proposal.Round,
+			VotingRound: proposal.VotingRound,
+			Leader:      leader,
+			Votes:       make(map[string]bool),
+			Approved:    proposal.Approved,
+		}
+		for _, id := range proposal.Team {
+			player, err := find(id)
+			if err != nil {
+				return nil, err
+			}
+			p.Team = append(p.Team, player)
+		}
+		for id, vote := range proposal.Votes {
+			if _, err := find(id); err != nil {
+				return nil, err
+			}
+			p.Votes[id] = vote
+		}
+		s.Proposals = append(s.Proposals, p)
+	}
+	if s.State == STATE_MISSION && len(s.Missions) == 0 {
+		return nil, fmt.Errorf("No running mission in checkpoint of game %s", c.ID)
+	}
+	return s, nil
+}
+
+// restoreGame recreates a game from its checkpoint and starts its daemon,
+// which picks up in the phase the game was saved in.
+func restoreGame(c *Checkpoint, eventHandler EventHandler) (*Game, error) {
+	s, err := c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, exists := games[c.ID]; exists {
+		return nil, fmt.Errorf("Game %s already exists", c.ID)
+	}
+	game := newGame(c.ID, []EventHandler{eventHandler})
+	game.state = *s
+	game.resumed = true
+	game.publish()
+	games[c.ID] = game
+	for _, player := range s.Players {
+		// Unconfirmed rematch players are free until they join
+		if !s.Unconfirmed[player.ID] {
+			registerPlayer(player.ID, c.ID)
+		}
+	}
+	go game.daemon()
+	return game, nil
+}
+
+// Shutdown suspends every running game and saves it to store. Each game
+// stops where it is and tells its players that it will resume, see Resume.
+func Shutdown(ctx context.Context, store Store) error {
+	var failed []string
+	for _, game := range ListGames() {
+		if err := game.send(ctx, &command{kind: cmdSuspend}); err != nil {
+			if err != ErrGameOver {
+				logging.With("game_id", game.ID).Errorf("Error suspending game: %s", err.Error())
+				failed = append(failed, game.ID)
+			}
+			continue
+		}
+		// The daemon has exited, so the snapshot is final
+		if err := store.Save(newCheckpoint(game.Snapshot())); err != nil {
+			logging.With("game_id", game.ID).Errorf("Error saving game: %s", err.Error())
+			failed = append(failed, game.ID)
+			continue
+		}
+		logging.With("game_id", game.ID).Infof("Game saved")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Cannot save %d game(s): %v", len(failed), failed)
+	}
+	return nil
+}
+
+// Resume restarts the games saved in store by Shutdown. Their events are
+// dispatched to eventHandler. Checkpoints are removed from the store once
+// their game is running again.
+func Resume(store Store, eventHandler EventHandler) (int, error) {
+	checkpoints, err := store.LoadAll()
+	if err != nil {
+		return 0, err
+	}
+	resumed := 0
+	for _, c := range checkpoints {
+		if _, err := restoreGame(c, eventHandler); err != nil {
+			logging.With("game_id", c.ID).Errorf("Error resuming game: %s", err.Error())
+			continue
+		}
+		if err := store.Delete(c.ID); err != nil {
+			logging.With("game_id", c.ID).Warnf("Error deleting checkpoint: %s", err.Error())
+		}
+		logging.With("game_id", c.ID).Infof("Game resumed")
+		resumed++
+	}
+	return resumed, nil
+}
@@ -0,0 +1,124 @@
+package resistance
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestShutdownAndResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := newRecorder()
+	game := newTestGame(t, "test-resume", 5, rec)
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	leader := <-rec.startPick
+	s := game.Snapshot()
+	if err := game.Pick(ctx, leader.ID, s.Players[0].ID); err != nil {
+		t.Fatalf("Pick: %s", err)
+	}
+
+	within(t, time.Second, "shutdown", func() {
+		if err := Shutdown(ctx, store); err != nil {
+			t.Errorf("Shutdown: %s", err)
+		}
+	})
+	if LoadGame("test-resume") != nil {
+		t.Fatalf("suspended game is still registered")
+	}
+	if err := game.Info(ctx); err != ErrGameOver {
+		t.Errorf("Info on a suspended game returned %v", err)
+	}
+	saved := game.Snapshot()
+
+	n, err := Resume(store, rec)
+	if err != nil || n != 1 {
+		t.Fatalf("Resume resumed %d game(s): %v", n, err)
+	}
+	resumed := LoadGame("test-resume")
+	if resumed == nil {
+		t.Fatalf("resumed game is not registered")
+	}
+	defer resumed.Abort(ctx, "system")
+	if leader := <-rec.startPick; leader.ID != saved.leader().ID {
+		t.Errorf("resumed with leader %s, expected %s", leader.ID, saved.leader().ID)
+	}
+
+	r := resumed.Snapshot()
+	if r.State != STATE_PICK || r.Round != saved.Round || r.VotingRound != saved.VotingRound {
+		t.Errorf("resumed in %s round %d.%d, expected %s round %d.%d",
+			r.State, r.Round, r.VotingRound, saved.State, saved.Round, saved.VotingRound)
+	}
+	for i, player := range saved.Players {
+		if r.Players[i].ID != player.ID || r.Players[i].Role != player.Role {
+			t.Errorf("player %d is %+v, expected %+v", i, r.Players[i], player)
+		}
+	}
+	if len(r.Picks) != 1 || r.Picks[s.Players[0].ID] == nil {
+		t.Errorf("picks are not restored: %v", r.Picks)
+	}
+
+	// The resumed game goes on where it stopped
+	if err := resumed.DonePick(ctx, leader.ID); err == nil {
+		t.Errorf("DonePick with too few members succeeded")
+	}
+	if checkpoints, _ := store.LoadAll(); len(checkpoints) != 0 {
+		t.Errorf("%d checkpoint(s) left after resume", len(checkpoints))
+	}
+
+	// Resumed games can be killed like any other
+	within(t, time.Second, "kill", func() {
+		resumed.Kill()
+		<-resumed.done
+	})
+	if LoadGame("test-resume") != nil {
+		t.Errorf("killed game is still registered")
+	}
+}
+
+func TestResumeRematch(t *testing.T) {
+	game := newTestGame(t, "test-resume-rematch", 5, newRecorder())
+	previous := game.Snapshot()
+	game.Abort(ctx, "system")
+	rematch := NewRematch("test-resume-rematch", previous, false, newRecorder())
+	if err := rematch.AddPlayer(ctx, &Player{ID: playerID(0), Name: playerID(0)}); err != nil {
+		t.Fatalf("confirming %s: %s", playerID(0), err)
+	}
+	c := newCheckpoint(rematch.Snapshot())
+	rematch.Kill()
+	<-rematch.done
+
+	resumed, err := restoreGame(c, newRecorder())
+	if err != nil {
+		t.Fatalf("restoreGame: %s", err)
+	}
+	defer resumed.Abort(ctx, "system")
+	if games := GamesByPlayer(playerID(0)); len(games) != 1 || games[0] != resumed {
+		t.Errorf("confirmed player is registered in %d games", len(games))
+	}
+	if games := GamesByPlayer(playerID(1)); len(games) != 0 {
+		t.Errorf("unconfirmed player is registered in %d games", len(games))
+	}
+
+	// Entries of games that are gone are left out
+	lock.Lock()
+	registerPlayer(playerID(1), "test-resume-gone")
+	lock.Unlock()
+	if games := GamesByPlayer(playerID(1)); len(games) != 0 {
+		t.Errorf("GamesByPlayer returned %d games for a game that is gone", len(games))
+	}
+	lock.Lock()
+	unregisterPlayers("test-resume-gone", []*Player{{ID: playerID(1)}})
+	lock.Unlock()
+}
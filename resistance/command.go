@@ -0,0 +1,195 @@
+package resistance
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// commandTimeout bounds how long webhook and HTTP handlers wait for a game to
+// answer a command.
+var commandTimeout = 10 * time.Second
+
+type commandKind int
+
+const (
+	cmdAddPlayer commandKind = iota
+	cmdStart
+	cmdAbort
+	cmdPick
+	cmdDonePick
+	cmdVote
+	cmdExecuteMission
+	cmdShowPlayers
+	cmdInfo
+	cmdSuspend
+	cmdKick
+	cmdPing
+	cmdReady
+	cmdExtend
+	cmdReachable
+)
+
+var commandNames = map[commandKind]string{
+	cmdAddPlayer:      "addPlayer",
+	cmdStart:          "start",
+	cmdAbort:          "abort",
+	cmdPick:           "pick",
+	cmdDonePick:       "donePick",
+	cmdVote:           "vote",
+	cmdExecuteMission: "executeMission",
+	cmdShowPlayers:    "showPlayers",
+	cmdInfo:           "info",
+	cmdSuspend:        "suspend",
+	cmdKick:           "kick",
+	cmdPing:           "ping",
+	cmdReady:          "ready",
+	cmdExtend:         "extend",
+	cmdReachable:      "reachable",
+}
+
+func (k commandKind) String() string {
+	return commandNames[k]
+}
+
+// command is a request to the daemon. The daemon always answers on reply,
+// which is buffered so that it never blocks on a caller that gave up.
+type command struct {
+	ctx  context.Context
+	kind commandKind
+	// playerID is the player issuing the command: the one joining, the
+	// aborter, the leader, the voter, etc.
+	playerID string
+	// player is the joining player, for cmdAddPlayer
+	player *Player
+	// targetID is the picked player, for cmdPick
+	targetID string
+	// value is the vote, the mission card, or whether the player is
+	// reachable, for cmdVote, cmdExecuteMission and cmdReachable
+	value bool
+
+	reply chan error
+}
+
+// rejections are returned for commands that are not allowed in the current
+// phase.
+var rejections = map[commandKind]error{
+	cmdAddPlayer:      fmt.Errorf("Cannot add player to a running game"),
+	cmdStart:          fmt.Errorf("Game already started"),
+	cmdKick:           fmt.Errorf("Cannot kick players from a running game"),
+	cmdReady:          fmt.Errorf("Game already started"),
+	cmdExtend:         fmt.Errorf("Game already started"),
+	cmdPick:           fmt.Errorf("Cannot pick now"),
+	cmdDonePick:       fmt.Errorf("Cannot done picking now"),
+	cmdVote:           fmt.Errorf("Cannot vote now"),
+	cmdExecuteMission: fmt.Errorf("Cannot run mission now"),
+}
+
+// ErrExpired is returned for commands made in an earlier phase, see
+// WithPhase.
+var ErrExpired = fmt.Errorf("This button has expired")
+
+type phaseKey struct{}
+
+// WithPhase makes the commands sent with ctx fail with ErrExpired if the
+// game is no longer in the given phase, see Snapshot.Phase.
+func WithPhase(ctx context.Context, phase int) context.Context {
+	return context.WithValue(ctx, phaseKey{}, phase)
+}
+
+// rejected tells whether err is one of rejections.
+func rejected(err error) bool {
+	for _, rejection := range rejections {
+		if err == rejection {
+			return true
+		}
+	}
+	return false
+}
+
+// send hands cmd over to the daemon and waits for its answer. It gives up
+// when ctx is done, and returns ErrGameOver if the daemon has exited.
+func (game *Game) send(ctx context.Context, cmd *command) error {
+	cmd.ctx = ctx
+	cmd.reply = make(chan error, 1)
+
+	select {
+	case game.commands <- cmd:
+	case <-game.done:
+		return ErrGameOver
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-cmd.reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (game *Game) AddPlayer(ctx context.Context, newPlayer *Player) error {
+	return game.send(ctx, &command{kind: cmdAddPlayer, playerID: newPlayer.ID, player: newPlayer})
+}
+
+func (game *Game) Start(ctx context.Context, starter string) error {
+	return game.send(ctx, &command{kind: cmdStart, playerID: starter})
+}
+
+// Kick removes the players who can't receive private messages from a game
+// that has not started yet.
+func (game *Game) Kick(ctx context.Context, kicker string) error {
+	return game.send(ctx, &command{kind: cmdKick, playerID: kicker})
+}
+
+// Ready marks the player as ready to play. The game starts once everyone is
+// ready.
+func (game *Game) Ready(ctx context.Context, playerID string) error {
+	return game.send(ctx, &command{kind: cmdReady, playerID: playerID})
+}
+
+// Extend starts the countdown of the lobby over, see
+// conf.GameLobbyExtensions.
+func (game *Game) Extend(ctx context.Context, playerID string) error {
+	return game.send(ctx, &command{kind: cmdExtend, playerID: playerID})
+}
+
+func (game *Game) Abort(ctx context.Context, aborter string) error {
+	return game.send(ctx, &command{kind: cmdAbort, playerID: aborter})
+}
+
+func (game *Game) Pick(ctx context.Context, leader, picked string) error {
+	return game.send(ctx, &command{kind: cmdPick, playerID: leader, targetID: picked})
+}
+
+func (game *Game) DonePick(ctx context.Context, leader string) error {
+	return game.send(ctx, &command{kind: cmdDonePick, playerID: leader})
+}
+
+func (game *Game) Vote(ctx context.Context, playerID string, vote bool) error {
+	return game.send(ctx, &command{kind: cmdVote, playerID: playerID, value: vote})
+}
+
+func (game *Game) ExecuteMission(ctx context.Context, playerID string, success bool) error {
+	return game.send(ctx, &command{kind: cmdExecuteMission, playerID: playerID, value: success})
+}
+
+// Unreachable tells the game that playerID can't receive private messages,
+// e.g. because pushing to them failed for good, see Outbox.
+func (game *Game) Unreachable(ctx context.Context, playerID string) error {
+	return game.send(ctx, &command{kind: cmdReachable, playerID: playerID, value: false})
+}
+
+// Ping returns once the daemon has answered, see Health.
+func (game *Game) Ping(ctx context.Context) error {
+	return game.send(ctx, &command{kind: cmdPing})
+}
+
+func (game *Game) ShowPlayers(ctx context.Context) error {
+	return game.send(ctx, &command{kind: cmdShowPlayers})
+}
+
+func (game *Game) Info(ctx context.Context) error {
+	return game.send(ctx, &command{kind: cmdInfo})
+}
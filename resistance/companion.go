@@ -0,0 +1,170 @@
+package resistance
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/azaky/resistancebot/logging"
+	"github.com/azaky/resistancebot/util"
+)
+
+// Companion serves a small web page per player and game at
+// /play/:gameID/:playerID/:signature, for players whose LINE client can't
+// render postback templates. The page shows the player's role and lets them
+// vote and play mission cards.
+type Companion struct {
+	baseURL string
+	secret  string
+	page    *template.Template
+}
+
+type companionPage struct {
+	Game    *PublicGame
+	Player  *Player
+	Spy     bool
+	Spies   []string
+	CanVote bool
+	// Vote is "approve" or "reject" once the player has voted this round
+	Vote       string
+	CanExecute bool
+	Error      string
+}
+
+func NewCompanion(baseURL, secret string) *Companion {
+	return &Companion{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+		page:    template.Must(template.New("companion").Parse(companionTemplate)),
+	}
+}
+
+// URL returns the signed link to the companion page of a player. The
+// signature covers the nonce of the game, so the link stops working once
+// the group starts another game.
+func (c *Companion) URL(game *Snapshot, playerID string) string {
+	return c.baseURL + "/play/" + url.PathEscape(game.ID) + "/" + url.PathEscape(playerID) + "/" + util.Sign(c.secret, game.ID, playerID, game.nonce)
+}
+
+func (c *Companion) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/play"), "/"), "/")
+	if len(parts) != 3 {
+		http.NotFound(w, req)
+		return
+	}
+	gameID, playerID := parts[0], parts[1]
+
+	game := LoadGame(gameID)
+	if game == nil {
+		http.Error(w, "This game is over", http.StatusGone)
+		return
+	}
+	if !util.Verify(c.secret, parts[2], gameID, playerID, game.Snapshot().nonce) {
+		// Also links of earlier games in the same group
+		http.NotFound(w, req)
+		return
+	}
+	player := game.Snapshot().FindPlayerByID(playerID)
+	if player == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	var actionError error
+	if req.Method == http.MethodPost {
+		ctx, cancel := context.WithTimeout(req.Context(), commandTimeout)
+		defer cancel()
+		switch req.FormValue("action") {
+		case "vote":
+			actionError = game.Vote(ctx, playerID, req.FormValue("value") == "approve")
+		case "mission":
+			actionError = game.ExecuteMission(ctx, playerID, req.FormValue("value") == "success")
+		}
+		if actionError == nil {
+			// Post/Redirect/Get, so that reloading doesn't resubmit
+			http.Redirect(w, req, req.URL.Path, http.StatusSeeOther)
+			return
+		}
+	}
+
+	s := game.Snapshot()
+	data := companionPage{
+		Game:   s.PublicView(),
+		Player: player,
+		Spy:    player.Role == ROLE_SPY && s.State != STATE_INITIALIZED,
+	}
+	if data.Spy {
+		for _, spy := range s.Players {
+			if spy.Role == ROLE_SPY && spy.ID != player.ID {
+				data.Spies = append(data.Spies, spy.Name)
+			}
+		}
+	}
+	switch s.State {
+	case STATE_VOTING:
+		data.CanVote = true
+		if vote, ok := s.Votes[playerID]; ok {
+			data.Vote = "reject"
+			if vote {
+				data.Vote = "approve"
+			}
+		}
+	case STATE_MISSION:
+		data.CanExecute = s.CurrentMission().HasMember(playerID)
+	}
+	if actionError != nil {
+		data.Error = actionError.Error()
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := c.page.Execute(w, data); err != nil {
+		logging.With("component", "companion").Errorf("Error rendering page: %s", err.Error())
+	}
+}
+
+const companionTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="10">
+<title>The Resistance</title>
+<style>
+body { font-family: sans-serif; max-width: 30em; margin: 1em auto; padding: 0 1em; }
+button { font-size: 1.2em; padding: .5em 1em; margin: .2em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Hi, {{.Player.Name}}</h1>
+{{if eq .Game.State "initialized"}}
+<p>The game has not started yet.</p>
+{{else}}
+<p>You are a <strong>{{if .Spy}}Spy{{else}}Resistance{{end}}</strong>.</p>
+{{if .Spies}}<p>The other spies: {{range $i, $spy := .Spies}}{{if $i}}, {{end}}{{$spy}}{{end}}</p>{{end}}
+<p>Mission #{{.Game.Round}}, Leader #{{.Game.VotingRound}}{{with .Game.Leader}} ({{.Name}}){{end}}</p>
+{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .CanVote}}
+<h2>Vote on team</h2>
+<ul>{{range .Game.Team}}<li>{{.Name}}{{if .Leader}} (leader){{end}}</li>{{end}}</ul>
+{{if .Vote}}<p>You voted {{.Vote}}. You can change it before the time runs out.</p>{{end}}
+<form method="post">
+<input type="hidden" name="action" value="vote">
+<button name="value" value="approve">Approve</button>
+<button name="value" value="reject">Reject</button>
+</form>
+{{end}}
+{{if .CanExecute}}
+<h2>Execute mission</h2>
+<form method="post">
+<input type="hidden" name="action" value="mission">
+<button name="value" value="success">Success</button>
+<button name="value" value="fail">Fail</button>
+</form>
+{{end}}
+</body>
+</html>
+`
@@ -0,0 +1,30 @@
+package resistance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompanionLinkIsBoundToTheGame(t *testing.T) {
+	c := NewCompanion("http://example.com", "secret")
+	game := newTestGame(t, "test-companion", 1, newRecorder())
+	link := c.URL(game.Snapshot(), playerID(0))
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link, nil))
+		return w.Code
+	}
+	if code := get(); code != http.StatusOK {
+		t.Errorf("link of the running game returned %d", code)
+	}
+	game.Abort(ctx, "system")
+
+	// The next game in the same group
+	game = newTestGame(t, "test-companion", 1, newRecorder())
+	defer game.Abort(ctx, "system")
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("link of an earlier game returned %d", code)
+	}
+}
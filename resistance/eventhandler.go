@@ -0,0 +1,197 @@
+package resistance
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/azaky/resistancebot/logging"
+)
+
+// BaseEventHandler implements every EventHandler callback as a no-op. Embed
+// it in handlers that are only interested in a few events.
+type BaseEventHandler struct{}
+
+func (BaseEventHandler) OnCreate(*Snapshot)                            {}
+func (BaseEventHandler) OnAbort(*Snapshot, *Player)                    {}
+func (BaseEventHandler) OnStart(*Snapshot, *Player, *Config, error)    {}
+func (BaseEventHandler) OnAddPlayer(*Snapshot, *Player, error)         {}
+func (BaseEventHandler) OnKick(*Snapshot, []*Player, error)            {}
+func (BaseEventHandler) OnDrop(*Snapshot, []*Player)                   {}
+func (BaseEventHandler) OnReady(*Snapshot, *Player, error)             {}
+func (BaseEventHandler) OnExtend(*Snapshot, *Player, error)            {}
+func (BaseEventHandler) OnUnreachable(*Snapshot, *Player)              {}
+func (BaseEventHandler) OnStartPick(*Snapshot, *Player)                {}
+func (BaseEventHandler) OnPick(*Snapshot, *Player, *Player, error)     {}
+func (BaseEventHandler) OnUnpick(*Snapshot, *Player, *Player, error)   {}
+func (BaseEventHandler) OnDonePick(*Snapshot, *Player, error)          {}
+func (BaseEventHandler) OnStartVoting(*Snapshot, *Player, []*Player)   {}
+func (BaseEventHandler) OnVote(*Snapshot, *Player, bool, error)        {}
+func (BaseEventHandler) OnVotingDone(*Snapshot, map[string]bool, bool) {}
+func (BaseEventHandler) OnStartMission(*Snapshot, []*Player)           {}
+func (BaseEventHandler) OnExecuteMission(*Snapshot, *Player, bool)     {}
+func (BaseEventHandler) OnMissionDone(*Snapshot, *Mission)             {}
+func (BaseEventHandler) OnSpyWin(*Snapshot)                            {}
+func (BaseEventHandler) OnResistanceWin(*Snapshot)                     {}
+func (BaseEventHandler) OnShowPlayers(*Snapshot, []*Player, int, bool) {}
+func (BaseEventHandler) OnInfo(*Snapshot, *Config)                     {}
+func (BaseEventHandler) OnStartWarning(*Snapshot, int)                 {}
+func (BaseEventHandler) OnVotingWarning(*Snapshot, int)                {}
+func (BaseEventHandler) OnMissionWarning(*Snapshot, int)               {}
+func (BaseEventHandler) OnSuspend(*Snapshot)                           {}
+func (BaseEventHandler) OnResume(*Snapshot)                            {}
+
+// MultiEventHandler forwards every callback to all registered handlers, in
+// registration order. A panicking handler is logged and skipped, so that a
+// broken subscriber can't take down the others (or the game).
+type MultiEventHandler struct {
+	lock     *sync.RWMutex
+	handlers []EventHandler
+}
+
+func NewMultiEventHandler(handlers ...EventHandler) *MultiEventHandler {
+	return &MultiEventHandler{
+		lock:     &sync.RWMutex{},
+		handlers: handlers,
+	}
+}
+
+// Register adds a handler. It affects running games as well.
+func (m *MultiEventHandler) Register(handler EventHandler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.handlers = append(m.handlers, handler)
+}
+
+func (m *MultiEventHandler) each(event string, f func(EventHandler)) {
+	m.lock.RLock()
+	handlers := m.handlers
+	m.lock.RUnlock()
+
+	for _, handler := range handlers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logging.WithFields(logging.Fields{
+						"game_handler": fmt.Sprintf("%T", handler),
+						"stack":        string(debug.Stack()),
+					}).Errorf("Handler panicked on %s: %v", event, r)
+				}
+			}()
+			f(handler)
+		}()
+	}
+}
+
+func (m *MultiEventHandler) OnCreate(game *Snapshot) {
+	m.each("OnCreate", func(h EventHandler) { h.OnCreate(game) })
+}
+
+func (m *MultiEventHandler) OnAbort(game *Snapshot, aborter *Player) {
+	m.each("OnAbort", func(h EventHandler) { h.OnAbort(game, aborter) })
+}
+
+func (m *MultiEventHandler) OnStart(game *Snapshot, starter *Player, c *Config, err error) {
+	m.each("OnStart", func(h EventHandler) { h.OnStart(game, starter, c, err) })
+}
+
+func (m *MultiEventHandler) OnAddPlayer(game *Snapshot, player *Player, err error) {
+	m.each("OnAddPlayer", func(h EventHandler) { h.OnAddPlayer(game, player, err) })
+}
+
+func (m *MultiEventHandler) OnKick(game *Snapshot, players []*Player, err error) {
+	m.each("OnKick", func(h EventHandler) { h.OnKick(game, players, err) })
+}
+
+func (m *MultiEventHandler) OnDrop(game *Snapshot, players []*Player) {
+	m.each("OnDrop", func(h EventHandler) { h.OnDrop(game, players) })
+}
+
+func (m *MultiEventHandler) OnReady(game *Snapshot, player *Player, err error) {
+	m.each("OnReady", func(h EventHandler) { h.OnReady(game, player, err) })
+}
+
+func (m *MultiEventHandler) OnExtend(game *Snapshot, player *Player, err error) {
+	m.each("OnExtend", func(h EventHandler) { h.OnExtend(game, player, err) })
+}
+
+func (m *MultiEventHandler) OnUnreachable(game *Snapshot, player *Player) {
+	m.each("OnUnreachable", func(h EventHandler) { h.OnUnreachable(game, player) })
+}
+
+func (m *MultiEventHandler) OnStartPick(game *Snapshot, leader *Player) {
+	m.each("OnStartPick", func(h EventHandler) { h.OnStartPick(game, leader) })
+}
+
+func (m *MultiEventHandler) OnPick(game *Snapshot, leader *Player, picked *Player, err error) {
+	m.each("OnPick", func(h EventHandler) { h.OnPick(game, leader, picked, err) })
+}
+
+func (m *MultiEventHandler) OnUnpick(game *Snapshot, leader *Player, unpicked *Player, err error) {
+	m.each("OnUnpick", func(h EventHandler) { h.OnUnpick(game, leader, unpicked, err) })
+}
+
+func (m *MultiEventHandler) OnDonePick(game *Snapshot, leader *Player, err error) {
+	m.each("OnDonePick", func(h EventHandler) { h.OnDonePick(game, leader, err) })
+}
+
+func (m *MultiEventHandler) OnStartVoting(game *Snapshot, leader *Player, members []*Player) {
+	m.each("OnStartVoting", func(h EventHandler) { h.OnStartVoting(game, leader, members) })
+}
+
+func (m *MultiEventHandler) OnVote(game *Snapshot, player *Player, vote bool, err error) {
+	m.each("OnVote", func(h EventHandler) { h.OnVote(game, player, vote, err) })
+}
+
+func (m *MultiEventHandler) OnVotingDone(game *Snapshot, votes map[string]bool, majority bool) {
+	m.each("OnVotingDone", func(h EventHandler) { h.OnVotingDone(game, votes, majority) })
+}
+
+func (m *MultiEventHandler) OnStartMission(game *Snapshot, members []*Player) {
+	m.each("OnStartMission", func(h EventHandler) { h.OnStartMission(game, members) })
+}
+
+func (m *MultiEventHandler) OnExecuteMission(game *Snapshot, player *Player, success bool) {
+	m.each("OnExecuteMission", func(h EventHandler) { h.OnExecuteMission(game, player, success) })
+}
+
+func (m *MultiEventHandler) OnMissionDone(game *Snapshot, mission *Mission) {
+	m.each("OnMissionDone", func(h EventHandler) { h.OnMissionDone(game, mission) })
+}
+
+func (m *MultiEventHandler) OnSpyWin(game *Snapshot) {
+	m.each("OnSpyWin", func(h EventHandler) { h.OnSpyWin(game) })
+}
+
+func (m *MultiEventHandler) OnResistanceWin(game *Snapshot) {
+	m.each("OnResistanceWin", func(h EventHandler) { h.OnResistanceWin(game) })
+}
+
+func (m *MultiEventHandler) OnShowPlayers(game *Snapshot, players []*Player, leaderIndex int, over bool) {
+	m.each("OnShowPlayers", func(h EventHandler) { h.OnShowPlayers(game, players, leaderIndex, over) })
+}
+
+func (m *MultiEventHandler) OnInfo(game *Snapshot, c *Config) {
+	m.each("OnInfo", func(h EventHandler) { h.OnInfo(game, c) })
+}
+
+func (m *MultiEventHandler) OnStartWarning(game *Snapshot, seconds int) {
+	m.each("OnStartWarning", func(h EventHandler) { h.OnStartWarning(game, seconds) })
+}
+
+func (m *MultiEventHandler) OnVotingWarning(game *Snapshot, seconds int) {
+	m.each("OnVotingWarning", func(h EventHandler) { h.OnVotingWarning(game, seconds) })
+}
+
+func (m *MultiEventHandler) OnMissionWarning(game *Snapshot, seconds int) {
+	m.each("OnMissionWarning", func(h EventHandler) { h.OnMissionWarning(game, seconds) })
+}
+
+func (m *MultiEventHandler) OnSuspend(game *Snapshot) {
+	m.each("OnSuspend", func(h EventHandler) { h.OnSuspend(game) })
+}
+
+func (m *MultiEventHandler) OnResume(game *Snapshot) {
+	m.each("OnResume", func(h EventHandler) { h.OnResume(game) })
+}
@@ -0,0 +1,257 @@
+package resistance
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azaky/resistancebot/logging"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	feedWriteTimeout = 10 * time.Second
+	feedPingInterval = 30 * time.Second
+	feedBufferSize   = 32
+)
+
+// FeedEvent is a public game event, as streamed to feed subscribers.
+type FeedEvent struct {
+	Type   string      `json:"type"`
+	GameID string      `json:"game_id"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+type feedVote struct {
+	Name    string `json:"name"`
+	Approve bool   `json:"approve"`
+}
+
+type feedSubscriber struct {
+	send chan []byte
+}
+
+// Feed streams the public events of a game over WebSocket at
+// /ws/games/:id, e.g. to project the board on a screen. Only information
+// that is already announced to the group is published. Subscribe it to the
+// games' events with LineBot.Subscribe.
+type Feed struct {
+	BaseEventHandler
+
+	lock        *sync.RWMutex
+	subscribers map[string]map[*feedSubscriber]bool
+	upgrader    websocket.Upgrader
+}
+
+func NewFeed() *Feed {
+	return &Feed{
+		lock:        &sync.RWMutex{},
+		subscribers: make(map[string]map[*feedSubscriber]bool),
+		upgrader: websocket.Upgrader{
+			// The feed is read-only and public, so any page may embed it
+			CheckOrigin: func(req *http.Request) bool { return true },
+		},
+	}
+}
+
+func (f *Feed) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/ws/games"), "/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	conn, err := f.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		logging.With("component", "feed").Warnf("Error upgrading connection: %s", err.Error())
+		return
+	}
+
+	s := &feedSubscriber{send: make(chan []byte, feedBufferSize)}
+	f.subscribe(id, s)
+
+	// Greet with the current state, so that late joiners can draw the board
+	if game := LoadGame(id); game != nil {
+		f.deliver(s, FeedEvent{Type: "state", GameID: id, Time: time.Now(), Data: game.Snapshot().PublicView()})
+	}
+
+	go f.write(conn, s)
+
+	// We don't expect anything from the client, but reading is needed to
+	// process control frames and to notice when it goes away.
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+	f.unsubscribe(id, s)
+	conn.Close()
+}
+
+func (f *Feed) write(conn *websocket.Conn, s *feedSubscriber) {
+	ticker := time.NewTicker(feedPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-s.send:
+			conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				conn.Close()
+				return
+			}
+
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (f *Feed) subscribe(id string, s *feedSubscriber) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.subscribers[id]; !ok {
+		f.subscribers[id] = make(map[*feedSubscriber]bool)
+	}
+	f.subscribers[id][s] = true
+}
+
+func (f *Feed) unsubscribe(id string, s *feedSubscriber) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.subscribers[id][s]; !ok {
+		return
+	}
+	delete(f.subscribers[id], s)
+	if len(f.subscribers[id]) == 0 {
+		delete(f.subscribers, id)
+	}
+	close(s.send)
+}
+
+func (f *Feed) deliver(s *feedSubscriber, event FeedEvent) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		logging.With("component", "feed").Errorf("Error encoding event: %s", err.Error())
+		return
+	}
+	select {
+	case s.send <- message:
+	default:
+		// Drop events for subscribers that can't keep up rather than
+		// stalling the game.
+	}
+}
+
+func (f *Feed) publish(game *Snapshot, eventType string, data interface{}) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	event := FeedEvent{
+		Type:   eventType,
+		GameID: game.ID,
+		Time:   time.Now(),
+		Data:   data,
+	}
+	for s := range f.subscribers[game.ID] {
+		f.deliver(s, event)
+	}
+}
+
+func (f *Feed) OnStart(game *Snapshot, starter *Player, c *Config, err error) {
+	if err != nil {
+		return
+	}
+	f.publish(game, "game_started", game.PublicView())
+}
+
+func (f *Feed) OnAbort(game *Snapshot, aborter *Player) {
+	f.publish(game, "game_aborted", nil)
+}
+
+func (f *Feed) OnAddPlayer(game *Snapshot, player *Player, err error) {
+	if err != nil {
+		return
+	}
+	f.publish(game, "player_joined", PublicPlayer{Name: player.Name})
+}
+
+func (f *Feed) OnKick(game *Snapshot, players []*Player, err error) {
+	if err != nil {
+		return
+	}
+	f.publish(game, "players_kicked", publicPlayers(players, nil))
+}
+
+func (f *Feed) OnDrop(game *Snapshot, players []*Player) {
+	f.publish(game, "players_dropped", publicPlayers(players, nil))
+}
+
+func (f *Feed) OnReady(game *Snapshot, player *Player, err error) {
+	if err != nil {
+		return
+	}
+	f.publish(game, "player_ready", PublicPlayer{Name: player.Name})
+}
+
+func (f *Feed) OnStartPick(game *Snapshot, leader *Player) {
+	f.publish(game, "leader_changed", map[string]interface{}{
+		"round":        game.Round,
+		"voting_round": game.VotingRound,
+		"leader":       PublicPlayer{Name: leader.Name, Leader: true},
+	})
+}
+
+func (f *Feed) OnStartVoting(game *Snapshot, leader *Player, members []*Player) {
+	f.publish(game, "team_proposed", map[string]interface{}{
+		"round":        game.Round,
+		"voting_round": game.VotingRound,
+		"leader":       PublicPlayer{Name: leader.Name, Leader: true},
+		"team":         publicPlayers(members, leader),
+	})
+}
+
+func (f *Feed) OnVotingDone(game *Snapshot, votes map[string]bool, majority bool) {
+	list := []feedVote{}
+	for name, vote := range votes {
+		list = append(list, feedVote{Name: name, Approve: vote})
+	}
+	f.publish(game, "vote_result", map[string]interface{}{
+		"round":        game.Round,
+		"voting_round": game.VotingRound,
+		"votes":        list,
+		"approved":     majority,
+	})
+}
+
+func (f *Feed) OnMissionDone(game *Snapshot, mission *Mission) {
+	f.publish(game, "mission_result", PublicMission{
+		Round:    mission.Round,
+		Members:  publicPlayers(mission.Members, nil),
+		Done:     true,
+		Success:  mission.Success,
+		NSuccess: mission.NSuccess(),
+		NFail:    mission.NFail(),
+	})
+}
+
+func (f *Feed) OnSpyWin(game *Snapshot) {
+	f.publish(game, "game_over", map[string]string{"winner": "spy", "message": defaultTemplates.render("spy_win", newGameOverMessage(game))})
+}
+
+func (f *Feed) OnResistanceWin(game *Snapshot) {
+	f.publish(game, "game_over", map[string]string{"winner": "resistance", "message": defaultTemplates.render("resistance_win", newGameOverMessage(game))})
+}
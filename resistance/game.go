@@ -1,13 +1,19 @@
 package resistance
 
 import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/azaky/resistancebot/config"
+	"github.com/azaky/resistancebot/logging"
 )
 
 type State int
@@ -27,6 +33,36 @@ const (
 	STATE_MISSION
 )
 
+func (s State) String() string {
+	switch s {
+	case STATE_IDLE:
+		return "idle"
+	case STATE_INITIALIZED:
+		return "initialized"
+	case STATE_PICK:
+		return "pick"
+	case STATE_VOTING:
+		return "voting"
+	case STATE_MISSION:
+		return "mission"
+	}
+	return "unknown"
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for state := STATE_IDLE; state <= STATE_MISSION; state++ {
+		if state.String() == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown state %q", text)
+}
+
 type Role int
 
 const (
@@ -48,6 +84,33 @@ type Mission struct {
 	MinFail int
 }
 
+// Proposal is a team that was voted on, approved or not. Votes has the
+// players who voted, by ID; the others count as Reject.
+type Proposal struct {
+	Round       int
+	VotingRound int
+	Leader      *Player
+	Team        []*Player
+	Votes       map[string]bool
+	Approved    bool
+}
+
+// Voters splits players by their vote on the team, keeping their order.
+func (p *Proposal) Voters(players []*Player) (approve, reject, notVoted []*Player) {
+	for _, player := range players {
+		vote, voted := p.Votes[player.ID]
+		switch {
+		case !voted:
+			notVoted = append(notVoted, player)
+		case vote:
+			approve = append(approve, player)
+		default:
+			reject = append(reject, player)
+		}
+	}
+	return
+}
+
 func (m *Mission) HasMember(playerID string) bool {
 	for _, member := range m.Members {
 		if member.ID == playerID {
@@ -88,21 +151,6 @@ func (m *Mission) NFail() int {
 	return nfail
 }
 
-type pickData struct {
-	LeaderID string
-	PlayerID string
-}
-
-type voteData struct {
-	PlayerID string
-	Vote     bool
-}
-
-type executeMissionData struct {
-	PlayerID string
-	Success  bool
-}
-
 type Config struct {
 	NPlayers  int
 	NSpies    int
@@ -173,115 +221,164 @@ var gameConfigMap = map[int]*Config{
 }
 
 type Game struct {
-	ID          string
-	Players     []*Player
-	NPlayers    int
-	State       State
-	Round       int
-	Picks       map[string]*Player
-	VotingRound int
-	Votes       map[string]bool
-	LeaderIndex int
-	Missions    []*Mission
-	Config      *Config
+	ID string
 
-	spyWonByRejection bool
+	// state is the working copy of the game state. It is owned by the
+	// daemon goroutine: nothing else may read or write it. Everyone else
+	// reads the immutable copy published in snapshot, see Snapshot().
+	state    Snapshot
+	snapshot atomic.Value
 
 	r *rand.Rand
 
-	cAddPlayer          chan error
-	cAddPlayerData      chan *Player
-	cAbortData          chan string
-	cAbort              chan error
-	cStartData          chan string
-	cStart              chan error
-	cPick               chan error
-	cPickData           chan pickData
-	cDonePick           chan error
-	cDonePickData       chan string
-	cVote               chan error
-	cVoteData           chan voteData
-	cExecuteMission     chan error
-	cExecuteMissionData chan executeMissionData
-	cShowPlayers        chan interface{}
-	cShowPlayersData    chan interface{}
-	cInfo               chan interface{}
-	cInfoData           chan interface{}
+	// resumed is set for games restored from a checkpoint
+	resumed bool
+
+	// commands carries every request to the daemon
+	commands chan *command
+	// done is closed when the daemon exits
+	done chan struct{}
+	// kill is closed to end a daemon that stopped answering, see Kill
+	kill     chan struct{}
+	killOnce sync.Once
 
 	EventHandler
 }
 
 type EventHandler interface {
-	OnCreate(*Game)
-	OnAbort(*Game, *Player)
-	OnStart(*Game, *Player, *Config, error)
-	OnAddPlayer(*Game, *Player, error)
-	OnStartPick(*Game, *Player)
-	OnPick(*Game, *Player, *Player, error)
-	OnUnpick(*Game, *Player, *Player, error)
-	OnDonePick(*Game, *Player, error)
-	OnStartVoting(*Game, *Player, []*Player)
-	OnVote(*Game, *Player, bool, error)
-	OnVotingDone(*Game, map[string]bool, bool)
-	OnStartMission(*Game, []*Player)
-	OnExecuteMission(*Game, *Player, bool)
-	OnMissionDone(*Game, *Mission)
-	OnSpyWin(*Game, string)
-	OnResistanceWin(*Game, string)
-	OnShowPlayers(*Game, []*Player, int, bool)
-	OnInfo(*Game, *Config)
-	OnStartWarning(*Game, int)
-	OnVotingWarning(*Game, int)
-	OnMissionWarning(*Game, int)
+	OnCreate(*Snapshot)
+	OnAbort(*Snapshot, *Player)
+	OnStart(*Snapshot, *Player, *Config, error)
+	OnAddPlayer(*Snapshot, *Player, error)
+	OnKick(*Snapshot, []*Player, error)
+	OnDrop(*Snapshot, []*Player)
+	OnReady(*Snapshot, *Player, error)
+	OnExtend(*Snapshot, *Player, error)
+	OnUnreachable(*Snapshot, *Player)
+	OnStartPick(*Snapshot, *Player)
+	OnPick(*Snapshot, *Player, *Player, error)
+	OnUnpick(*Snapshot, *Player, *Player, error)
+	OnDonePick(*Snapshot, *Player, error)
+	OnStartVoting(*Snapshot, *Player, []*Player)
+	OnVote(*Snapshot, *Player, bool, error)
+	OnVotingDone(*Snapshot, map[string]bool, bool)
+	OnStartMission(*Snapshot, []*Player)
+	OnExecuteMission(*Snapshot, *Player, bool)
+	OnMissionDone(*Snapshot, *Mission)
+	OnSpyWin(*Snapshot)
+	OnResistanceWin(*Snapshot)
+	OnShowPlayers(*Snapshot, []*Player, int, bool)
+	OnInfo(*Snapshot, *Config)
+	OnStartWarning(*Snapshot, int)
+	OnVotingWarning(*Snapshot, int)
+	OnMissionWarning(*Snapshot, int)
+	OnSuspend(*Snapshot)
+	OnResume(*Snapshot)
+}
+
+// Reachability tells whether a player can receive private messages, e.g.
+// they may not have added the bot as friend. Games check players in the
+// background as they join, and refuse to start while any can't, see
+// SetReachability.
+type Reachability interface {
+	// Reachable fails when it can't tell, e.g. because LINE is unavailable.
+	Reachable(playerID string) (bool, error)
+}
+
+var reachability Reachability
+
+// SetReachability sets the check every game runs on joining players. It
+// should be called before any game is created.
+func SetReachability(r Reachability) {
+	lock.Lock()
+	defer lock.Unlock()
+	reachability = r
 }
 
 var games map[string]*Game = make(map[string]*Game)
+
+// playerGames maps each player to the IDs of the games they are in. It is
+// guarded by lock, along with games.
+var playerGames map[string]map[string]bool = make(map[string]map[string]bool)
 var lock *sync.RWMutex = &sync.RWMutex{}
 var conf config.Config = config.Get()
 
-func NewGame(id string, eventHandler EventHandler) *Game {
+// NewGame creates a game and starts its daemon. Events are dispatched to all
+// given handlers, see MultiEventHandler.
+func NewGame(id string, eventHandlers ...EventHandler) *Game {
 	lock.Lock()
 	defer lock.Unlock()
 
 	if game, exists := games[id]; exists {
 		return game
 	}
-	game := &Game{
-		ID:                  id,
-		Players:             []*Player{},
-		NPlayers:            0,
-		State:               STATE_INITIALIZED,
-		Round:               0,
-		VotingRound:         0,
-		LeaderIndex:         -1,
-		Missions:            []*Mission{},
-		cAddPlayer:          make(chan error),
-		cAddPlayerData:      make(chan *Player),
-		cAbortData:          make(chan string),
-		cAbort:              make(chan error),
-		cStartData:          make(chan string),
-		cStart:              make(chan error),
-		cPick:               make(chan error),
-		cPickData:           make(chan pickData),
-		cDonePick:           make(chan error),
-		cDonePickData:       make(chan string),
-		cVote:               make(chan error),
-		cVoteData:           make(chan voteData),
-		cExecuteMission:     make(chan error),
-		cExecuteMissionData: make(chan executeMissionData),
-		cShowPlayers:        make(chan interface{}),
-		cShowPlayersData:    make(chan interface{}),
-		cInfo:               make(chan interface{}),
-		cInfoData:           make(chan interface{}),
-		EventHandler:        eventHandler,
-		r:                   rand.New(rand.NewSource(time.Now().Unix())),
-		spyWonByRejection:   false,
+	game := newGame(id, eventHandlers)
+	game.publish()
+	games[id] = game
+	go game.daemon()
+	return game
+}
+
+// NewRematch creates a game with the players of previous, who confirm by
+// joining. Until then they are free to join other games, and those who
+// haven't confirmed when the game starts are dropped.
+// With rotate, the seating is kept and the next player leads first;
+// otherwise the seating is shuffled as usual.
+func NewRematch(id string, previous *Snapshot, rotate bool, eventHandlers ...EventHandler) *Game {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if game, exists := games[id]; exists {
+		return game
 	}
+	game := newGame(id, eventHandlers)
+	players := previous.Players
+	if rotate && len(players) > 0 {
+		players = append(players[1:len(players):len(players)], players[0])
+	}
+	game.state.Unconfirmed = make(map[string]bool)
+	game.state.KeepSeating = rotate
+	for _, player := range players {
+		// Players are registered once they confirm, see addPlayer
+		game.state.Players = append(game.state.Players, &Player{ID: player.ID, Name: player.Name})
+		game.state.Unconfirmed[player.ID] = true
+	}
+	game.state.NPlayers = len(game.state.Players)
+	game.publish()
 	games[id] = game
 	go game.daemon()
 	return game
 }
 
+// newGame sets up a game in the lobby, without starting it.
+func newGame(id string, eventHandlers []EventHandler) *Game {
+	var eventHandler EventHandler
+	if len(eventHandlers) == 1 {
+		eventHandler = eventHandlers[0]
+	} else {
+		eventHandler = NewMultiEventHandler(eventHandlers...)
+	}
+	return &Game{
+		ID: id,
+		state: Snapshot{
+			ID:          id,
+			Players:     []*Player{},
+			NPlayers:    0,
+			State:       STATE_INITIALIZED,
+			Round:       0,
+			VotingRound: 0,
+			LeaderIndex: -1,
+			Missions:    []*Mission{},
+			nonce:       newNonce(),
+		},
+		commands:     make(chan *command),
+		done:         make(chan struct{}),
+		kill:         make(chan struct{}),
+		EventHandler: eventHandler,
+		r:            rand.New(rand.NewSource(time.Now().Unix())),
+	}
+}
+
 func GameExistsByID(id string) bool {
 	lock.RLock()
 	defer lock.RUnlock()
@@ -300,478 +397,639 @@ func LoadGame(id string) *Game {
 	return nil
 }
 
-func DeleteGame(id string) bool {
+// GamesByPlayer returns the running games userID plays in, ordered by ID.
+// Unless conf.GameAllowMultiple is set, there is at most one.
+func GamesByPlayer(userID string) []*Game {
 	lock.RLock()
 	defer lock.RUnlock()
 
-	_, exists := games[id]
-	delete(games, id)
-	return exists
+	var list []*Game
+	for id := range playerGames[userID] {
+		// Skip entries left behind by a game that is already gone
+		if game, ok := games[id]; ok {
+			list = append(list, game)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
 }
 
-func (game *Game) daemon() {
-	game.OnCreate(game)
-
-	// init:
-	var startError error
-	initTimer := time.NewTimer(time.Duration(conf.GameInitializationTime) * time.Second)
-	init30Timer := time.NewTimer(time.Duration(conf.GameInitializationTime-30) * time.Second)
-	init15Timer := time.NewTimer(time.Duration(conf.GameInitializationTime-15) * time.Second)
-
-	for {
-		select {
-		case newPlayer := <-game.cAddPlayerData:
-			log.Println("c:addPlayer")
-			game.cAddPlayer <- game.addPlayer(newPlayer)
-
-		case starter := <-game.cStartData:
-			log.Println("c:start")
-			startError = game.start(starter)
-			game.cStart <- startError
-			if startError == nil {
-				goto start
-			} else {
-				startError = nil
-			}
+// registerPlayer and unregisterPlayers must be called with lock held.
+func registerPlayer(userID, gameID string) {
+	if playerGames[userID] == nil {
+		playerGames[userID] = make(map[string]bool)
+	}
+	playerGames[userID][gameID] = true
+}
 
-		case <-initTimer.C:
-			log.Println("c:initTimer")
-			startError = game.start("timer")
-			goto start
-
-		case <-init30Timer.C:
-			log.Println("c:init30Timer")
-			go game.OnStartWarning(game, 30)
-
-		case <-init15Timer.C:
-			log.Println("c:init15Timer")
-			go game.OnStartWarning(game, 15)
-
-		case aborter := <-game.cAbortData:
-			log.Println("c:abort")
-			game.abort(aborter)
-			return
-
-		case <-game.cShowPlayersData:
-			log.Println("c:showPlayers")
-			game.showPlayers()
-			game.cShowPlayers <- nil
-
-		case <-game.cInfoData:
-			log.Println("c:info")
-			game.info()
-			game.cInfo <- nil
+func unregisterPlayers(gameID string, players []*Player) {
+	for _, player := range players {
+		delete(playerGames[player.ID], gameID)
+		if len(playerGames[player.ID]) == 0 {
+			delete(playerGames, player.ID)
 		}
 	}
+}
 
-start:
-	initTimer.Stop()
-	if startError != nil {
-		game.abort("system")
-		return
+// ListGames returns all running games, ordered by ID.
+func ListGames() []*Game {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var list []*Game
+	for _, game := range games {
+		list = append(list, game)
 	}
-	game.Round = 1
-
-pick:
-	time.Sleep(3 * time.Second)
-	game.State = STATE_PICK
-	game.VotingRound++
-	game.LeaderIndex++
-	game.LeaderIndex %= game.NPlayers
-	game.Picks = make(map[string]*Player)
-	go game.OnStartPick(game, game.leader())
-
-	for {
-		select {
-		case data := <-game.cPickData:
-			log.Println("c:pick")
-			game.cPick <- game.pick(data)
-
-		case leader := <-game.cDonePickData:
-			log.Println("c:donePick")
-			errDonePick := game.donePick(leader)
-			game.cDonePick <- errDonePick
-			if errDonePick == nil {
-				goto voting
-			}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
 
-		case aborter := <-game.cAbortData:
-			log.Println("c:abort")
-			game.abort(aborter)
-			return
+func DeleteGame(id string) bool {
+	lock.Lock()
+	defer lock.Unlock()
 
-		case <-game.cShowPlayersData:
-			log.Println("c:showPlayers")
-			game.showPlayers()
-			game.cShowPlayers <- nil
+	game, exists := games[id]
+	if exists {
+		unregisterPlayers(id, game.Snapshot().Players)
+	}
+	delete(games, id)
+	return exists
+}
 
-		case <-game.cInfoData:
-			log.Println("c:info")
-			game.info()
-			game.cInfo <- nil
-		}
+func newNonce() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ErrGameOver is returned by the game's methods once its daemon has exited.
+var ErrGameOver = fmt.Errorf("The game is already over")
+
+// phaseDelay is the pause before a phase is announced, giving players time to
+// read the previous one, see phase.announce.
+var phaseDelay = 3 * time.Second
+
+func (game *Game) logFields() logging.Fields {
+	return logging.Fields{
+		"game_id":      game.ID,
+		"phase":        game.state.State.String(),
+		"round":        game.state.Round,
+		"voting_round": game.state.VotingRound,
 	}
+}
 
-voting:
-	time.Sleep(3 * time.Second)
-	game.State = STATE_VOTING
-	game.Votes = make(map[string]bool)
-	go game.OnStartVoting(game, game.leader(), game.GetPicks())
-	votingTimer := time.NewTimer(time.Duration(conf.GameVotingTime) * time.Second)
-	voting15Timer := time.NewTimer(time.Duration(conf.GameVotingTime-15) * time.Second)
+// log returns a logger with the game's ID, phase and round. It reads the
+// working state, so only the daemon may call it.
+func (game *Game) log() *logging.Logger {
+	return logging.WithFields(game.logFields())
+}
 
-	for {
-		select {
-		case data := <-game.cVoteData:
-			game.cVote <- game.vote(data)
+// Snapshot returns an immutable copy of the current state of the game. It
+// is safe to call from any goroutine.
+func (game *Game) Snapshot() *Snapshot {
+	return game.snapshot.Load().(*Snapshot)
+}
 
-		case <-voting15Timer.C:
-			go game.OnVotingWarning(game, 15)
+// publish makes the working state visible to other goroutines. It must be
+// called by the daemon after every change, and the returned snapshot is
+// what should be passed to event handlers.
+func (game *Game) publish() *Snapshot {
+	s := game.state.clone()
+	game.snapshot.Store(s)
+	return s
+}
 
-		case <-votingTimer.C:
-			goto voting_done
+func (game *Game) startPick() {
+	game.state.VotingRound++
+	game.state.LeaderIndex++
+	game.state.LeaderIndex %= game.state.NPlayers
+	game.state.Picks = make(map[string]*Player)
+	game.publish()
+}
 
-		case aborter := <-game.cAbortData:
-			log.Println("c:abort")
-			game.abort(aborter)
-			return
+// announcePick shows the leader their options. After a restart, what they
+// already picked is kept.
+func (game *Game) announcePick() {
+	s := game.publish()
+	go game.OnStartPick(s, s.leader())
+}
 
-		case <-game.cShowPlayersData:
-			log.Println("c:showPlayers")
-			game.showPlayers()
-			game.cShowPlayers <- nil
+func (game *Game) startVoting() {
+	game.state.Votes = make(map[string]bool)
+	game.publish()
+}
 
-		case <-game.cInfoData:
-			log.Println("c:info")
-			game.info()
-			game.cInfo <- nil
-		}
-	}
+// announceVoting asks for votes. After a restart, votes already cast are
+// kept.
+func (game *Game) announceVoting() {
+	s := game.publish()
+	go game.OnStartVoting(s, s.leader(), s.GetPicks())
+}
 
-voting_done:
-	time.Sleep(3 * time.Second)
+// finishVoting counts the votes once the voting time is up, and decides
+// where the game goes next.
+func (game *Game) finishVoting() State {
 	majority := game.calculateVote()
 	votes := make(map[string]bool)
-	for id, vote := range game.Votes {
-		votes[game.FindPlayerByID(id).Name] = vote
+	for id, vote := range game.state.Votes {
+		votes[game.state.FindPlayerByID(id).Name] = vote
 	}
-	go game.OnVotingDone(game, votes, majority)
-	time.Sleep(3 * time.Second)
-	if majority {
-		goto mission
-	} else if game.VotingRound == conf.GameVotingRound {
+	game.recordProposal(majority)
+	s := game.Snapshot()
+	if !majority && game.state.VotingRound == conf.GameVotingRound {
 		// force spy win
-		game.spyWonByRejection = true
-		go game.OnSpyWin(game, fmt.Sprintf("Concensus are not reached after %d times voting. Spy won!", conf.GameVotingRound))
+		game.state.spyWonByRejection = true
 		game.cleanup()
-		return
-	} else {
-		goto pick
+		over := game.Snapshot()
+		// One goroutine, so that the vote is out before the spy win
+		go func() {
+			game.OnVotingDone(s, votes, majority)
+			game.OnSpyWin(over)
+		}()
+		return STATE_IDLE
 	}
+	go game.OnVotingDone(s, votes, majority)
+	if majority {
+		return STATE_MISSION
+	}
+	return STATE_PICK
+}
 
-mission:
-	game.State = STATE_MISSION
-	game.startMission()
-	missionTimer := time.NewTimer(time.Duration(conf.GameMissionTime) * time.Second)
-	mission15Timer := time.NewTimer(time.Duration(conf.GameMissionTime-15) * time.Second)
-
-	for {
-		select {
-		case data := <-game.cExecuteMissionData:
-			game.cExecuteMission <- game.executeMission(data)
-
-		case <-mission15Timer.C:
-			go game.OnMissionWarning(game, 15)
-
-		case <-missionTimer.C:
-			goto mission_done
-
-		case aborter := <-game.cAbortData:
-			log.Println("c:abort")
-			game.abort(aborter)
-			return
-
-		case <-game.cShowPlayersData:
-			log.Println("c:showPlayers")
-			game.showPlayers()
-			game.cShowPlayers <- nil
-
-		case <-game.cInfoData:
-			log.Println("c:info")
-			game.info()
-			game.cInfo <- nil
-		}
+func (game *Game) recordProposal(approved bool) {
+	votes := make(map[string]bool)
+	for id, vote := range game.state.Votes {
+		votes[id] = vote
 	}
+	game.state.Proposals = append(game.state.Proposals, &Proposal{
+		Round:       game.state.Round,
+		VotingRound: game.state.VotingRound,
+		Leader:      game.state.leader(),
+		Team:        game.state.GetPicks(),
+		Votes:       votes,
+		Approved:    approved,
+	})
+	game.publish()
+}
 
-mission_done:
-	currentMission := game.CurrentMission()
-	currentMission.Execute()
-	game.OnMissionDone(game, currentMission)
+// finishMission reveals the outcome of the mission once the mission time is
+// up, and decides where the game goes next.
+func (game *Game) finishMission() State {
+	game.state.CurrentMission().Execute()
+	s := game.publish()
+	game.OnMissionDone(s, s.CurrentMission())
 
-	if game.SpyWin() {
-		game.OnSpyWin(game, fmt.Sprintf("Spy won!"))
+	// Handlers get the game as it ended, no mission running, see Export
+	if game.state.SpyWin() {
 		game.cleanup()
-		return
+		game.OnSpyWin(game.Snapshot())
+		return STATE_IDLE
 	}
-	if game.ResistanceWin() {
-		game.OnResistanceWin(game, fmt.Sprintf("Resistance won!"))
+	if game.state.ResistanceWin() {
 		game.cleanup()
-		return
+		game.OnResistanceWin(game.Snapshot())
+		return STATE_IDLE
 	}
 
-	game.Round++
-	game.VotingRound = 0
-	goto pick
+	game.state.Round++
+	game.state.VotingRound = 0
+	return STATE_PICK
+}
+
+// suspend stops the game without ending it, so that it can be saved and
+// resumed later.
+func (game *Game) suspend() {
+	lock.Lock()
+	game.unregister(game.state.Players)
+	lock.Unlock()
+	game.OnSuspend(game.Snapshot())
 }
 
 func (game *Game) cleanup() {
 	lock.Lock()
 	defer lock.Unlock()
-	game.State = STATE_IDLE
-	delete(games, game.ID)
+	game.state.State = STATE_IDLE
+	game.publish()
+	game.unregister(game.state.Players)
 }
 
-func (game *Game) AddPlayer(newPlayer *Player) error {
-	if game.State != STATE_INITIALIZED {
-		log.Println("g:AddPlayer error")
-		return fmt.Errorf("Cannot add player to a running game")
+// unregister removes the game and its players from the registry, unless it
+// was already replaced by a newer game of the same group, see Kill. It must
+// be called with lock held.
+func (game *Game) unregister(players []*Player) {
+	if games[game.ID] != game {
+		return
 	}
-	log.Println("g:AddPlayer chan set")
-	game.cAddPlayerData <- newPlayer
-	return <-game.cAddPlayer
+	unregisterPlayers(game.ID, players)
+	delete(games, game.ID)
+}
+
+// Kill drops the game from the registry right away, so that the group can
+// start a new one, and ends the daemon once it gets back to its loop. It is
+// meant for daemons that stopped answering commands, see adminAbort.
+func (game *Game) Kill() {
+	game.killOnce.Do(func() {
+		close(game.kill)
+	})
+	lock.Lock()
+	defer lock.Unlock()
+	game.unregister(game.Snapshot().Players)
 }
 
 func (game *Game) addPlayer(newPlayer *Player) error {
-	if game.NPlayers == conf.GameMaxPlayers {
+	// Keep our own copy, the caller may still hold on to newPlayer
+	p := *newPlayer
+	if game.state.Unconfirmed[p.ID] {
+		// Confirming a rematch
+		lock.Lock()
+		if len(playerGames[p.ID]) > 0 && !conf.GameAllowMultiple {
+			lock.Unlock()
+			err := fmt.Errorf("%s is already playing in another game", p.Name)
+			go game.OnAddPlayer(game.Snapshot(), &p, err)
+			return err
+		}
+		registerPlayer(p.ID, game.ID)
+		lock.Unlock()
+		delete(game.state.Unconfirmed, p.ID)
+		s := game.publish()
+		go game.OnAddPlayer(s, s.FindPlayerByID(p.ID), nil)
+		game.checkReachability([]*Player{&p})
+		return nil
+	}
+	if game.state.NPlayers == conf.GameMaxPlayers {
 		err := fmt.Errorf("Cannot add more players")
-		go game.OnAddPlayer(game, newPlayer, err)
+		go game.OnAddPlayer(game.Snapshot(), &p, err)
 		return err
 	}
-	for _, player := range game.Players {
-		if player.ID == newPlayer.ID {
+	for _, player := range game.state.Players {
+		if player.ID == p.ID {
 			err := fmt.Errorf("%s is already in the game", player.Name)
-			go game.OnAddPlayer(game, newPlayer, err)
+			go game.OnAddPlayer(game.Snapshot(), &p, err)
 			return err
 		}
 	}
-	game.NPlayers++
-	game.Players = append(game.Players, newPlayer)
-	go game.OnAddPlayer(game, newPlayer, nil)
+	lock.Lock()
+	if len(playerGames[p.ID]) > 0 && !conf.GameAllowMultiple {
+		lock.Unlock()
+		err := fmt.Errorf("%s is already playing in another game", p.Name)
+		go game.OnAddPlayer(game.Snapshot(), &p, err)
+		return err
+	}
+	registerPlayer(p.ID, game.ID)
+	lock.Unlock()
+	game.state.NPlayers++
+	game.state.Players = append(game.state.Players, &p)
+	s := game.publish()
+	go game.OnAddPlayer(s, s.FindPlayerByID(p.ID), nil)
+	game.checkReachability([]*Player{&p})
+	return nil
+}
+
+// unreachable returns the players who can't receive private messages.
+func (game *Game) unreachable() []*Player {
+	var unreachable []*Player
+	for _, player := range game.state.Players {
+		if game.state.Unreachable[player.ID] {
+			unreachable = append(unreachable, player)
+		}
+	}
+	return unreachable
+}
+
+// checkReachability checks the players in the background, each on its own,
+// and tells the game with cmdReachable. Players who can't be checked are
+// left as they are.
+func (game *Game) checkReachability(players []*Player) {
+	lock.RLock()
+	r := reachability
+	lock.RUnlock()
+	if r == nil {
+		return
+	}
+	for _, player := range players {
+		id := player.ID
+		go func() {
+			reachable, err := r.Reachable(id)
+			if err != nil {
+				logging.WithFields(logging.Fields{"game_id": game.ID, "user_id": id}).Warnf("Cannot tell if player is reachable: %s", err.Error())
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+			defer cancel()
+			game.send(ctx, &command{kind: cmdReachable, playerID: id, value: reachable})
+		}()
+	}
+}
+
+// setReachable records whether the player can receive private messages.
+// The game won't start until the unreachable ones are kicked or reachable
+// again.
+func (game *Game) setReachable(playerID string, reachable bool) {
+	if game.state.FindPlayerByID(playerID) == nil || game.state.Unreachable[playerID] == !reachable {
+		return
+	}
+	if reachable {
+		delete(game.state.Unreachable, playerID)
+		game.publish()
+		return
+	}
+	if game.state.Unreachable == nil {
+		game.state.Unreachable = make(map[string]bool)
+	}
+	game.state.Unreachable[playerID] = true
+	s := game.publish()
+	go game.OnUnreachable(s, s.FindPlayerByID(playerID))
+}
+
+// kick removes the players that can't receive private messages, so that the
+// others can start without them.
+func (game *Game) kick(kicker string) error {
+	if game.state.FindPlayerByID(kicker) == nil {
+		return fmt.Errorf("Only players in the game can kick players")
+	}
+	unreachable := game.unreachable()
+	if len(unreachable) == 0 {
+		err := fmt.Errorf("Everyone can receive private messages, no one to kick")
+		go game.OnKick(game.Snapshot(), nil, err)
+		return err
+	}
+	kicked := make(map[string]bool)
+	var players []*Player
+	for _, player := range unreachable {
+		kicked[player.ID] = true
+		delete(game.state.Unconfirmed, player.ID)
+		delete(game.state.Ready, player.ID)
+		delete(game.state.Unreachable, player.ID)
+	}
+	for _, player := range game.state.Players {
+		if !kicked[player.ID] {
+			players = append(players, player)
+		}
+	}
+	game.state.Players = players
+	game.state.NPlayers = len(players)
+	lock.Lock()
+	unregisterPlayers(game.ID, unreachable)
+	lock.Unlock()
+	s := game.publish()
+	go game.OnKick(s, unreachable, nil)
 	return nil
 }
 
-func (game *Game) ShowPlayers() {
-	game.cShowPlayersData <- nil
-	<-game.cShowPlayers
-	return
+func (game *Game) ready(playerID string) error {
+	p := game.state.FindPlayerByID(playerID)
+	if p == nil {
+		err := fmt.Errorf("Only players in the game can be ready")
+		go game.OnReady(game.Snapshot(), nil, err)
+		return err
+	}
+	if game.state.Unconfirmed[playerID] {
+		err := fmt.Errorf("%s has to join the rematch first", p.Name)
+		go game.OnReady(game.Snapshot(), nil, err)
+		return err
+	}
+	if game.state.Ready[playerID] {
+		err := fmt.Errorf("%s is already ready", p.Name)
+		go game.OnReady(game.Snapshot(), nil, err)
+		return err
+	}
+	if game.state.Ready == nil {
+		game.state.Ready = make(map[string]bool)
+	}
+	game.state.Ready[playerID] = true
+	s := game.publish()
+	go game.OnReady(s, s.FindPlayerByID(playerID), nil)
+	return nil
 }
 
-func (game *Game) showPlayers() {
-	go game.OnShowPlayers(game, game.Players, game.LeaderIndex, game.Over())
-	return
+// allReady tells whether everyone in the lobby is ready, and there are
+// enough of them to start.
+func (game *Game) allReady() bool {
+	if game.state.NPlayers < conf.GameMinPlayers || len(game.state.Unconfirmed) > 0 {
+		return false
+	}
+	for _, player := range game.state.Players {
+		if !game.state.Ready[player.ID] {
+			return false
+		}
+	}
+	return true
 }
 
-func (game *Game) Info() {
-	game.cInfoData <- nil
-	<-game.cInfo
-	return
+// extend gives the lobby more time, either on request of a player or by the
+// timer when there are not enough players.
+func (game *Game) extend(extender string) error {
+	p := game.state.FindPlayerByID(extender)
+	if p == nil && extender != "timer" {
+		err := fmt.Errorf("Only players in the game can extend the waiting time")
+		go game.OnExtend(game.Snapshot(), nil, err)
+		return err
+	}
+	if game.state.Extensions >= conf.GameLobbyExtensions {
+		err := fmt.Errorf("The waiting time cannot be extended anymore")
+		go game.OnExtend(game.Snapshot(), p, err)
+		return err
+	}
+	game.state.Extensions++
+	s := game.publish()
+	go game.OnExtend(s, s.FindPlayerByID(extender), nil)
+	return nil
 }
 
-func (game *Game) info() {
-	if game.Config != nil {
-		go game.OnInfo(game, game.Config)
+// dropUnconfirmed removes the players of a rematch who did not confirm.
+func (game *Game) dropUnconfirmed() {
+	if len(game.state.Unconfirmed) == 0 {
+		return
 	}
+	var players, dropped []*Player
+	for _, player := range game.state.Players {
+		if game.state.Unconfirmed[player.ID] {
+			dropped = append(dropped, player)
+		} else {
+			players = append(players, player)
+		}
+	}
+	game.state.Players = players
+	game.state.NPlayers = len(players)
+	game.state.Unconfirmed = nil
+	s := game.publish()
+	go game.OnDrop(s, dropped)
+}
+
+func (game *Game) showPlayers() {
+	s := game.Snapshot()
+	go game.OnShowPlayers(s, s.Players, s.LeaderIndex, s.Over())
 	return
 }
 
-func (game *Game) Abort(aborter string) error {
-	game.cAbortData <- aborter
-	return <-game.cAbort
+func (game *Game) info() {
+	if s := game.Snapshot(); s.Config != nil {
+		go game.OnInfo(s, s.Config)
+	}
+	return
 }
 
 func (game *Game) abort(aborter string) error {
-	p := game.FindPlayerByID(aborter)
+	p := game.state.FindPlayerByID(aborter)
 	if p == nil && aborter != "system" {
 		return fmt.Errorf("Only players in the game can abort the game")
 	}
 	game.cleanup()
-	go game.OnAbort(game, p)
+	s := game.Snapshot()
+	go game.OnAbort(s, s.FindPlayerByID(aborter))
 	return nil
 }
 
-func (game *Game) Start(starter string) error {
-	if game.State != STATE_INITIALIZED {
-		return fmt.Errorf("Game already started")
-	}
-	game.cStartData <- starter
-	return <-game.cStart
-}
-
 func (game *Game) start(starter string) error {
-	p := game.FindPlayerByID(starter)
-	if p == nil && starter != "timer" {
+	p := game.Snapshot().FindPlayerByID(starter)
+	if (p == nil || game.state.Unconfirmed[starter]) && starter != "timer" {
 		err := fmt.Errorf("Only players in the game can start the game")
-		go game.OnStart(game, nil, nil, err)
+		go game.OnStart(game.Snapshot(), nil, nil, err)
 		return err
 	}
-	c, ok := gameConfigMap[game.NPlayers]
+	// Unconfirmed players are dropped once the game starts, so the checks
+	// only count those who confirmed
+	c, ok := gameConfigMap[game.state.NPlayers-len(game.state.Unconfirmed)]
 	if !ok {
 		// if game.NPlayers < conf.GameMinPlayers || game.NPlayers > conf.GameMaxPlayers {
 		err := fmt.Errorf("Number of players should be between %d and %d", conf.GameMinPlayers, conf.GameMaxPlayers)
-		go game.OnStart(game, p, nil, err)
+		go game.OnStart(game.Snapshot(), p, nil, err)
+		return err
+	}
+	var unreachable []*Player
+	for _, player := range game.unreachable() {
+		if !game.state.Unconfirmed[player.ID] {
+			unreachable = append(unreachable, player)
+		}
+	}
+	if len(unreachable) > 0 {
+		var names []string
+		for _, player := range unreachable {
+			names = append(names, player.Name)
+		}
+		err := fmt.Errorf("Cannot start the game, I can't send private messages to %s. Add me as friend, or type \".kick\" to remove them from the game", strings.Join(names, ", "))
+		go game.OnStart(game.Snapshot(), p, nil, err)
+		// They may have added the bot by the next .start
+		game.checkReachability(unreachable)
 		return err
 	}
-	game.Config = c
-	game.randomizePlayers()
+	game.dropUnconfirmed()
+	game.state.Config = c
+	if !game.state.KeepSeating {
+		game.randomizePlayers()
+	}
 	game.assignRoles()
-	go game.OnStart(game, p, c, nil)
+	game.state.Round = 1
+	s := game.publish()
+	go game.OnStart(s, s.FindPlayerByID(starter), c, nil)
 	return nil
 }
 
 func (game *Game) randomizePlayers() {
-	for i := game.NPlayers - 1; i >= 0; i-- {
+	players := game.state.Players
+	for i := game.state.NPlayers - 1; i >= 0; i-- {
 		x := game.r.Intn(i + 1)
-		temp := game.Players[i]
-		game.Players[i] = game.Players[x]
-		game.Players[x] = temp
+		temp := players[i]
+		players[i] = players[x]
+		players[x] = temp
 	}
 }
 
 func (game *Game) assignRoles() {
-	for _, player := range game.Players {
+	for _, player := range game.state.Players {
 		player.Role = ROLE_RESISTANCE
 	}
-	numSpy := game.Config.NSpies
+	numSpy := game.state.Config.NSpies
+	var spies []string
 	for numSpy > 0 {
-		x := game.r.Intn(game.NPlayers)
-		if game.Players[x].Role == ROLE_SPY {
+		x := game.r.Intn(game.state.NPlayers)
+		if game.state.Players[x].Role == ROLE_SPY {
 			continue
 		}
-		game.Players[x].Role = ROLE_SPY
+		game.state.Players[x].Role = ROLE_SPY
+		spies = append(spies, game.state.Players[x].ID)
 		numSpy--
 	}
+	// Roles are hidden information, never log them above debug level
+	game.log().With("spies", spies).Debugf("Roles assigned")
 }
 
-func (game *Game) FindPlayerByID(id string) *Player {
-	for _, player := range game.Players {
-		if player.ID == id {
-			return player
-		}
-	}
-	return nil
-}
-
-func (game *Game) leader() *Player {
-	return game.Players[game.LeaderIndex]
-}
-
-func (game *Game) Pick(leader, picked string) error {
-	if game.State != STATE_PICK {
-		return fmt.Errorf("Cannot pick now")
-	}
-	game.cPickData <- pickData{
-		LeaderID: leader,
-		PlayerID: picked,
-	}
-	return <-game.cPick
-}
-
-func (game *Game) pick(data pickData) error {
-	if data.LeaderID != game.leader().ID {
+func (game *Game) pick(leaderID, playerID string) error {
+	if leaderID != game.state.leader().ID {
 		// do not call OnPick error, just ignore it
 		return fmt.Errorf("You have no right to choose")
 	}
-	if p, ok := game.Picks[data.PlayerID]; ok {
-		delete(game.Picks, data.PlayerID)
-		go game.OnUnpick(game, game.leader(), p, nil)
+	if _, ok := game.state.Picks[playerID]; ok {
+		delete(game.state.Picks, playerID)
+		s := game.publish()
+		go game.OnUnpick(s, s.leader(), s.FindPlayerByID(playerID), nil)
 		return nil
 	}
-	p := game.FindPlayerByID(data.PlayerID)
+	p := game.state.FindPlayerByID(playerID)
 	if p == nil {
 		err := fmt.Errorf("Cannot choose players who are not in the game")
-		go game.OnPick(game, game.leader(), nil, err)
+		s := game.Snapshot()
+		go game.OnPick(s, s.leader(), nil, err)
 		return err
 	}
-	game.Picks[data.PlayerID] = p
-	go game.OnPick(game, game.leader(), p, nil)
+	game.state.Picks[playerID] = p
+	s := game.publish()
+	go game.OnPick(s, s.leader(), s.FindPlayerByID(playerID), nil)
 	return nil
 }
 
-func (game *Game) DonePick(leader string) error {
-	if game.State != STATE_PICK {
-		return fmt.Errorf("Cannot done picking now")
-	}
-	game.cDonePickData <- leader
-	return <-game.cDonePick
-}
-
 func (game *Game) donePick(leader string) error {
-	if leader != game.leader().ID {
+	if leader != game.state.leader().ID {
 		// do not call OnDonePick errror, just ignore it
 		return fmt.Errorf("You have no right to finish picking")
 	}
-	npicks := game.Config.NMembers[game.Round-1]
-	if len(game.Picks) != npicks {
+	npicks := game.state.Config.NMembers[game.state.Round-1]
+	s := game.Snapshot()
+	if len(game.state.Picks) != npicks {
 		err := fmt.Errorf("You must choose exactly %d people", npicks)
-		go game.OnPick(game, game.leader(), nil, err)
+		go game.OnPick(s, s.leader(), nil, err)
 		return err
 	}
-	go game.OnDonePick(game, game.leader(), nil)
+	go game.OnDonePick(s, s.leader(), nil)
 	return nil
 }
 
-func (game *Game) Vote(playerID string, vote bool) error {
-	if game.State != STATE_VOTING {
-		return fmt.Errorf("Cannot vote now")
-	}
-	game.cVoteData <- voteData{
-		PlayerID: playerID,
-		Vote:     vote,
-	}
-	return <-game.cVote
-}
-
-func (game *Game) vote(data voteData) error {
-	p := game.FindPlayerByID(data.PlayerID)
+func (game *Game) vote(playerID string, vote bool) error {
+	p := game.state.FindPlayerByID(playerID)
 	if p == nil {
 		err := fmt.Errorf("You are not in the game")
 		return err
 	}
-	game.Votes[data.PlayerID] = data.Vote
-	go game.OnVote(game, p, data.Vote, nil)
+	game.state.Votes[playerID] = vote
+	s := game.publish()
+	go game.OnVote(s, s.FindPlayerByID(playerID), vote, nil)
 	return nil
 }
 
 func (game *Game) calculateVote() bool {
+	return majority(game.state.Votes, game.state.NPlayers)
+}
+
+// majority tells whether a team is approved by votes. Players who did not
+// vote count as Reject.
+func majority(votes map[string]bool, nplayers int) bool {
 	yes := 0
-	for _, vote := range game.Votes {
+	for _, vote := range votes {
 		if vote {
 			yes++
 		} else {
 			yes--
 		}
 	}
-	yes -= game.NPlayers - len(game.Votes)
+	yes -= nplayers - len(votes)
 	return yes > 0
 }
 
-func (game *Game) GetPicks() []*Player {
-	var picks []*Player
-	for _, pick := range game.Picks {
-		picks = append(picks, pick)
-	}
-	return picks
-}
-
-func (game *Game) CurrentMission() *Mission {
-	if game.State != STATE_MISSION {
-		return nil
-	}
-	return game.Missions[len(game.Missions)-1]
-}
-
 func (game *Game) startMission() {
-	missionMembers := game.GetPicks()
+	missionMembers := game.state.GetPicks()
 	missionVotes := make(map[string]bool)
 	// vote success for mission by default
 	for _, member := range missionMembers {
@@ -779,87 +1037,41 @@ func (game *Game) startMission() {
 	}
 	newMission := &Mission{
 		Members: missionMembers,
-		Round:   game.Round,
+		Round:   game.state.Round,
 		Votes:   missionVotes,
-		MinFail: game.Config.NFail[game.Round-1],
+		MinFail: game.state.Config.NFail[game.state.Round-1],
 	}
-	game.Missions = append(game.Missions, newMission)
-	go game.OnStartMission(game, missionMembers)
+	game.state.Missions = append(game.state.Missions, newMission)
+	game.publish()
 }
 
-func (game *Game) ExecuteMission(playerID string, success bool) error {
-	if game.State != STATE_MISSION {
-		return fmt.Errorf("Cannot run mission now")
-	}
-	game.cExecuteMissionData <- executeMissionData{
-		PlayerID: playerID,
-		Success:  success,
-	}
-	return <-game.cExecuteMission
+// announceMission asks the members for their cards. After a restart, cards
+// already played are kept.
+func (game *Game) announceMission() {
+	s := game.publish()
+	go game.OnStartMission(s, s.CurrentMission().Members)
 }
 
-func (game *Game) executeMission(data executeMissionData) error {
-	mission := game.CurrentMission()
+func (game *Game) executeMission(playerID string, success bool) error {
+	mission := game.state.CurrentMission()
 	if mission == nil {
 		return fmt.Errorf("No running mission")
 	}
-	if !mission.HasMember(data.PlayerID) {
+	if !mission.HasMember(playerID) {
 		return fmt.Errorf("You are not part of mission")
 	}
 
-	player := game.FindPlayerByID(data.PlayerID)
+	player := game.state.FindPlayerByID(playerID)
 	// if player is resistance, vote true no matter what, i.e. ignore
 	if player.Role == ROLE_RESISTANCE {
 		// don't forget to call event handler
-		go game.OnExecuteMission(game, player, data.Success)
+		s := game.Snapshot()
+		go game.OnExecuteMission(s, s.FindPlayerByID(player.ID), success)
 		return nil
 	}
 
-	mission.Votes[player.ID] = data.Success
-	go game.OnExecuteMission(game, player, data.Success)
+	mission.Votes[player.ID] = success
+	s := game.publish()
+	go game.OnExecuteMission(s, s.FindPlayerByID(player.ID), success)
 	return nil
 }
-
-func (game *Game) SpyWin() bool {
-	if game.Config == nil {
-		return false
-	}
-	if game.spyWonByRejection {
-		return true
-	}
-	success := 0
-	fail := 0
-	for _, mission := range game.Missions {
-		if mission.Success {
-			success++
-		} else {
-			fail++
-		}
-	}
-	success += game.Config.NRounds - len(game.Missions)
-	return fail > success
-}
-
-func (game *Game) ResistanceWin() bool {
-	if game.Config == nil {
-		return false
-	}
-	if game.spyWonByRejection {
-		return false
-	}
-	success := 0
-	fail := 0
-	for _, mission := range game.Missions {
-		if mission.Success {
-			success++
-		} else {
-			fail++
-		}
-	}
-	fail += game.Config.NRounds - len(game.Missions)
-	return success > fail
-}
-
-func (game *Game) Over() bool {
-	return game.SpyWin() || game.ResistanceWin()
-}
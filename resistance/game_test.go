@@ -0,0 +1,792 @@
+package resistance
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These tests are meant to be run with -race: they hammer a game from many
+// goroutines at once, the way concurrent webhook deliveries do.
+
+var ctx = context.Background()
+
+func TestMain(m *testing.M) {
+	phaseDelay = 0
+	conf.GameInitializationTime = 3600
+	conf.GameVotingTime = 1
+	conf.GameMissionTime = 1
+	os.Exit(m.Run())
+}
+
+type recorder struct {
+	BaseEventHandler
+
+	startPick   chan *Player
+	startVoting chan []*Player
+	votingDone  chan bool
+	over        chan *Snapshot
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		startPick:   make(chan *Player, 16),
+		startVoting: make(chan []*Player, 16),
+		votingDone:  make(chan bool, 16),
+		over:        make(chan *Snapshot, 1),
+	}
+}
+
+func (r *recorder) OnStartPick(game *Snapshot, leader *Player) {
+	r.startPick <- leader
+}
+
+func (r *recorder) OnStartVoting(game *Snapshot, leader *Player, members []*Player) {
+	r.startVoting <- members
+}
+
+func (r *recorder) OnVotingDone(game *Snapshot, votes map[string]bool, majority bool) {
+	r.votingDone <- majority
+}
+
+func (r *recorder) OnSpyWin(game *Snapshot) {
+	r.over <- game
+}
+
+func (r *recorder) OnResistanceWin(game *Snapshot) {
+	r.over <- game
+}
+
+// Handlers read the snapshots they are given, which must not race with the
+// daemon either.
+func (r *recorder) OnShowPlayers(game *Snapshot, players []*Player, leaderIndex int, over bool) {
+	for _, player := range players {
+		_ = player.Name + fmt.Sprint(player.Role)
+	}
+}
+
+func (r *recorder) OnInfo(game *Snapshot, c *Config) {
+	_ = game.PublicView()
+}
+
+func playerID(i int) string {
+	return fmt.Sprintf("player%d", i)
+}
+
+func newTestGame(t *testing.T, id string, nplayers int, handler EventHandler) *Game {
+	game := NewGame(id, handler)
+	for i := 0; i < nplayers; i++ {
+		if err := game.AddPlayer(ctx, &Player{ID: playerID(i), Name: playerID(i)}); err != nil {
+			t.Fatalf("AddPlayer: %s", err)
+		}
+	}
+	return game
+}
+
+// readConcurrently keeps reading the game until stop is closed.
+func readConcurrently(game *Game, stop chan struct{}, wg *sync.WaitGroup) {
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s := game.Snapshot()
+				for _, player := range s.Players {
+					_ = player.Name
+				}
+				for _, pick := range s.Picks {
+					_ = pick.Name
+				}
+				_ = s.PublicView()
+				game.ShowPlayers(ctx)
+				game.Info(ctx)
+			}
+		}()
+	}
+}
+
+// playToEnd starts game and approves every team, with no one playing Fail,
+// until the resistance wins. It returns the snapshot the end of the game was
+// sent with.
+func playToEnd(t *testing.T, game *Game, rec *recorder) *Snapshot {
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	for {
+		select {
+		case leader := <-rec.startPick:
+			s := game.Snapshot()
+			for i := 0; i < s.Config.NMembers[s.Round-1]; i++ {
+				if err := game.Pick(ctx, leader.ID, s.Players[i].ID); err != nil {
+					t.Fatalf("Pick: %s", err)
+				}
+			}
+			if err := game.DonePick(ctx, leader.ID); err != nil {
+				t.Fatalf("DonePick: %s", err)
+			}
+		case <-rec.startVoting:
+			for _, player := range game.Snapshot().Players {
+				if err := game.Vote(ctx, player.ID, true); err != nil {
+					t.Fatalf("Vote: %s", err)
+				}
+			}
+		case s := <-rec.over:
+			return s
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Game did not end")
+		}
+	}
+}
+
+func within(t *testing.T, d time.Duration, what string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatalf("%s did not return within %s", what, d)
+	}
+}
+
+func TestConcurrentJoins(t *testing.T) {
+	game := NewGame("test-joins", newRecorder())
+	defer game.Abort(ctx, "system")
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readConcurrently(game, stop, &readers)
+
+	// Every player tries to join twice, and there are more players than
+	// seats.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	joined := 0
+	for i := 0; i < 2*conf.GameMaxPlayers; i++ {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if game.AddPlayer(ctx, &Player{ID: playerID(i), Name: playerID(i)}) == nil {
+					mu.Lock()
+					joined++
+					mu.Unlock()
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	if joined != conf.GameMaxPlayers {
+		t.Errorf("%d players joined, expected %d", joined, conf.GameMaxPlayers)
+	}
+	s := game.Snapshot()
+	if s.NPlayers != conf.GameMaxPlayers || len(s.Players) != conf.GameMaxPlayers {
+		t.Errorf("snapshot has %d (%d) players, expected %d", s.NPlayers, len(s.Players), conf.GameMaxPlayers)
+	}
+	seen := make(map[string]bool)
+	for _, player := range s.Players {
+		if seen[player.ID] {
+			t.Errorf("%s joined twice", player.ID)
+		}
+		seen[player.ID] = true
+	}
+}
+
+func TestConcurrentVotes(t *testing.T) {
+	rec := newRecorder()
+	game := newTestGame(t, "test-votes", 5, rec)
+	defer game.Abort(ctx, "system")
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readConcurrently(game, stop, &readers)
+	defer func() {
+		close(stop)
+		readers.Wait()
+	}()
+
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	leader := <-rec.startPick
+
+	// Everyone tries to pick at once, only the leader may.
+	s := game.Snapshot()
+	npicks := s.Config.NMembers[0]
+	var wg sync.WaitGroup
+	for i := 0; i < s.NPlayers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < npicks; j++ {
+				err := game.Pick(ctx, playerID(i), s.Players[j].ID)
+				if playerID(i) != leader.ID && err == nil {
+					t.Errorf("%s picked without being the leader", playerID(i))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := game.DonePick(ctx, leader.ID); err != nil {
+		t.Fatalf("DonePick: %s", err)
+	}
+	if members := <-rec.startVoting; len(members) != npicks {
+		t.Fatalf("%d members are voted on, expected %d", len(members), npicks)
+	}
+
+	// Players change their mind a few times, concurrently. Three of them
+	// end up approving.
+	for i := 0; i < s.NPlayers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				game.Vote(ctx, playerID(i), j%2 == 0)
+			}
+			if err := game.Vote(ctx, playerID(i), i < 3); err != nil {
+				t.Errorf("Vote: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if majority := <-rec.votingDone; !majority {
+		t.Errorf("majority is not reached with 3 out of 5 approvals")
+	}
+}
+
+// stuckHandler blocks the daemon in OnCreate until unblock is closed.
+type stuckHandler struct {
+	BaseEventHandler
+	unblock chan struct{}
+}
+
+func (h stuckHandler) OnCreate(*Snapshot) {
+	<-h.unblock
+}
+
+func TestKillStuckGame(t *testing.T) {
+	stuck := stuckHandler{unblock: make(chan struct{})}
+	old := NewGame("test-kill", stuck)
+	shortCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := old.Ping(shortCtx); err != context.DeadlineExceeded {
+		t.Fatalf("Ping to a stuck game returned %v", err)
+	}
+	old.Kill()
+
+	// The group starts over while the old daemon is still stuck
+	game := newTestGame(t, "test-kill", 3, newRecorder())
+	defer game.Abort(ctx, "system")
+	if game == old {
+		t.Fatalf("NewGame returned the killed game")
+	}
+	close(stuck.unblock)
+	within(t, 5*time.Second, "killed daemon", func() {
+		<-old.done
+	})
+
+	if LoadGame("test-kill") != game {
+		t.Errorf("The killed game removed the new one")
+	}
+	if games := GamesByPlayer(playerID(0)); len(games) != 1 || games[0] != game {
+		t.Errorf("The killed game unregistered the players of the new one: %v", games)
+	}
+	if err := game.Ping(ctx); err != nil {
+		t.Errorf("Ping: %s", err)
+	}
+}
+
+func TestConcurrentAborts(t *testing.T) {
+	game := newTestGame(t, "test-aborts", 5, newRecorder())
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readConcurrently(game, stop, &readers)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	aborted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if game.Abort(ctx, playerID(i%5)) == nil {
+				mu.Lock()
+				aborted++
+				mu.Unlock()
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			game.AddPlayer(ctx, &Player{ID: playerID(100 + i), Name: playerID(100 + i)})
+		}(i)
+	}
+	within(t, 5*time.Second, "concurrent aborts", wg.Wait)
+	close(stop)
+	within(t, 5*time.Second, "concurrent reads", readers.Wait)
+
+	if aborted != 1 {
+		t.Errorf("game aborted %d times", aborted)
+	}
+	if LoadGame("test-aborts") != nil {
+		t.Errorf("aborted game is still registered")
+	}
+	if s := game.Snapshot(); s.State != STATE_IDLE {
+		t.Errorf("aborted game is in state %s", s.State)
+	}
+
+	// A finished game must answer right away instead of hanging.
+	within(t, time.Second, "commands on a finished game", func() {
+		if err := game.Abort(ctx, playerID(0)); err != ErrGameOver {
+			t.Errorf("Abort on a finished game returned %v", err)
+		}
+		game.ShowPlayers(ctx)
+		game.Info(ctx)
+	})
+}
+
+func TestCancelledCommands(t *testing.T) {
+	game := newTestGame(t, "test-cancelled", 5, newRecorder())
+	defer game.Abort(ctx, "system")
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	within(t, time.Second, "commands with a cancelled context", func() {
+		if err := game.Start(cancelled, playerID(0)); err != context.Canceled {
+			t.Errorf("Start with a cancelled context returned %v", err)
+		}
+	})
+	if s := game.Snapshot(); s.State != STATE_INITIALIZED {
+		t.Errorf("game started with a cancelled context, it is in state %s", s.State)
+	}
+
+	// Commands that are not allowed in the current phase are rejected
+	// instead of being queued.
+	within(t, time.Second, "commands in the wrong phase", func() {
+		if err := game.Vote(ctx, playerID(0), true); err == nil {
+			t.Errorf("Vote before the game started succeeded")
+		}
+		if err := game.Pick(ctx, playerID(0), playerID(1)); err == nil {
+			t.Errorf("Pick before the game started succeeded")
+		}
+	})
+}
+
+// fakeReachability knows the players who can't be reached (true), and the
+// ones LINE fails to answer for (false). Everyone else is reachable.
+type fakeReachability map[string]bool
+
+func (f fakeReachability) Reachable(playerID string) (bool, error) {
+	unreachable, known := f[playerID]
+	if !known {
+		return true, nil
+	}
+	if !unreachable {
+		return false, fmt.Errorf("LINE is unavailable")
+	}
+	return false, nil
+}
+
+// waitUnreachable waits for the background checks to find n unreachable
+// players.
+func waitUnreachable(t *testing.T, game *Game, n int) {
+	within(t, 5*time.Second, "reachability checks", func() {
+		for len(game.Snapshot().Unreachable) < n {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestStartWithUnreachablePlayers(t *testing.T) {
+	SetReachability(fakeReachability{playerID(1): true, playerID(3): true, playerID(5): false})
+	defer SetReachability(nil)
+
+	game := newTestGame(t, "test-unreachable", 7, newRecorder())
+	defer game.Abort(ctx, "system")
+	waitUnreachable(t, game, 2)
+
+	err := game.Start(ctx, playerID(0))
+	if err == nil || !strings.Contains(err.Error(), playerID(1)) || !strings.Contains(err.Error(), playerID(3)) {
+		t.Fatalf("Start with unreachable players returned %v", err)
+	}
+	if err := game.Kick(ctx, "stranger"); err == nil {
+		t.Errorf("Kick by a stranger succeeded")
+	}
+	if err := game.Kick(ctx, playerID(0)); err != nil {
+		t.Fatalf("Kick: %s", err)
+	}
+	// Failing to ask LINE doesn't get anyone kicked
+	s := game.Snapshot()
+	if s.NPlayers != 5 || s.FindPlayerByID(playerID(1)) != nil || s.FindPlayerByID(playerID(3)) != nil || s.FindPlayerByID(playerID(5)) == nil {
+		t.Errorf("%d players left after kick: %v", s.NPlayers, s.Players)
+	}
+	if err := game.Kick(ctx, playerID(0)); err == nil {
+		t.Errorf("Kick with everyone reachable succeeded")
+	}
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Errorf("Start after kick: %s", err)
+	}
+}
+
+type unreachableRecorder struct {
+	*recorder
+	unreachable chan *Player
+}
+
+func (r unreachableRecorder) OnUnreachable(game *Snapshot, player *Player) {
+	r.unreachable <- player
+}
+
+func TestUndeliverablePlayers(t *testing.T) {
+	handler := unreachableRecorder{newRecorder(), make(chan *Player, 4)}
+	game := newTestGame(t, "test-undeliverable", 6, handler)
+	defer game.Abort(ctx, "system")
+
+	// Every failed push tells the game, which only tells the group once
+	for i := 0; i < 2; i++ {
+		if err := game.Unreachable(ctx, playerID(2)); err != nil {
+			t.Fatalf("Unreachable: %s", err)
+		}
+	}
+	if err := game.Unreachable(ctx, "stranger"); err != nil {
+		t.Fatalf("Unreachable: %s", err)
+	}
+	select {
+	case player := <-handler.unreachable:
+		if player.ID != playerID(2) {
+			t.Errorf("OnUnreachable for %s, expected %s", player.ID, playerID(2))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnUnreachable not called")
+	}
+	if err := game.Start(ctx, playerID(0)); err == nil || !strings.Contains(err.Error(), playerID(2)) {
+		t.Fatalf("Start with an undeliverable player returned %v", err)
+	}
+	if err := game.Kick(ctx, playerID(0)); err != nil {
+		t.Fatalf("Kick: %s", err)
+	}
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Errorf("Start after kick: %s", err)
+	}
+	select {
+	case player := <-handler.unreachable:
+		t.Errorf("OnUnreachable called again for %s", player.ID)
+	default:
+	}
+}
+
+func TestOneGamePerPlayer(t *testing.T) {
+	first := newTestGame(t, "test-first", 2, newRecorder())
+	defer first.Abort(ctx, "system")
+	second := NewGame("test-second", newRecorder())
+	defer second.Abort(ctx, "system")
+
+	if err := second.AddPlayer(ctx, &Player{ID: playerID(1), Name: playerID(1)}); err == nil {
+		t.Errorf("%s joined a second game", playerID(1))
+	}
+	if list := GamesByPlayer(playerID(1)); len(list) != 1 || list[0] != first {
+		t.Errorf("%s plays in %v", playerID(1), list)
+	}
+
+	conf.GameAllowMultiple = true
+	defer func() { conf.GameAllowMultiple = false }()
+	if err := second.AddPlayer(ctx, &Player{ID: playerID(1), Name: playerID(1)}); err != nil {
+		t.Fatalf("AddPlayer with multiple games allowed: %s", err)
+	}
+	if list := GamesByPlayer(playerID(1)); len(list) != 2 {
+		t.Errorf("%s plays in %d games, expected 2", playerID(1), len(list))
+	}
+
+	first.Abort(ctx, "system")
+	if list := GamesByPlayer(playerID(1)); len(list) != 1 || list[0] != second {
+		t.Errorf("%s still plays in an aborted game", playerID(1))
+	}
+	if list := GamesByPlayer(playerID(0)); len(list) != 0 {
+		t.Errorf("%s still plays in an aborted game", playerID(0))
+	}
+}
+
+func TestExpiredCommands(t *testing.T) {
+	rec := newRecorder()
+	game := newTestGame(t, "test-expired", 5, rec)
+	defer game.Abort(ctx, "system")
+
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	leader := <-rec.startPick
+	s := game.Snapshot()
+	if err := game.Pick(WithPhase(ctx, s.Phase-1), leader.ID, leader.ID); err != ErrExpired {
+		t.Errorf("Pick from an earlier phase returned %v", err)
+	}
+	if err := game.Pick(WithPhase(ctx, s.Phase), leader.ID, leader.ID); err != nil {
+		t.Errorf("Pick from the current phase: %s", err)
+	}
+
+	// A button of another game with the same ID doesn't verify
+	data := signPostback(s, ".donepick:"+s.ID)
+	other := s.clone()
+	other.nonce = newNonce()
+	if signPostback(other, ".donepick:"+s.ID) == data {
+		t.Errorf("games with different nonces sign the same data")
+	}
+}
+
+func TestProposals(t *testing.T) {
+	rec := newRecorder()
+	game := newTestGame(t, "test-proposals", 5, rec)
+	defer game.Abort(ctx, "system")
+
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	leader := <-rec.startPick
+	s := game.Snapshot()
+	for _, player := range s.Players[:s.Config.NMembers[0]] {
+		if err := game.Pick(ctx, leader.ID, player.ID); err != nil {
+			t.Fatalf("Pick: %s", err)
+		}
+	}
+	if err := game.DonePick(ctx, leader.ID); err != nil {
+		t.Fatalf("DonePick: %s", err)
+	}
+	<-rec.startVoting
+	game.Vote(ctx, playerID(0), true)
+	game.Vote(ctx, playerID(1), false)
+	if majority := <-rec.votingDone; majority {
+		t.Fatalf("majority is reached with 1 out of 5 approvals")
+	}
+	<-rec.startPick
+
+	s = game.Snapshot()
+	if len(s.Proposals) != 1 {
+		t.Fatalf("%d proposals recorded, expected 1", len(s.Proposals))
+	}
+	p := s.Proposals[0]
+	if p.Round != 1 || p.VotingRound != 1 || p.Leader.ID != leader.ID || p.Approved {
+		t.Errorf("unexpected proposal %+v", p)
+	}
+	for i, member := range p.Team {
+		if member != s.Players[i] {
+			t.Errorf("team member %d is %s, expected %s in seating order", i, member.ID, s.Players[i].ID)
+		}
+	}
+	approve, reject, notVoted := p.Voters(s.Players)
+	if len(approve) != 1 || len(reject) != 1 || len(notVoted) != 3 {
+		t.Errorf("votes are %d/%d/%d, expected 1/1/3", len(approve), len(reject), len(notVoted))
+	}
+
+	restored, err := newCheckpoint(s).snapshot()
+	if err != nil {
+		t.Fatalf("checkpoint: %s", err)
+	}
+	if len(restored.Proposals) != 1 || restored.Proposals[0].Leader.ID != leader.ID ||
+		len(restored.Proposals[0].Team) != len(p.Team) || len(restored.Proposals[0].Votes) != 2 {
+		t.Errorf("proposals are not restored: %+v", restored.Proposals)
+	}
+}
+
+func TestSpyWinByRejection(t *testing.T) {
+	rec := newRecorder()
+	game := newTestGame(t, "test-rejection", 5, rec)
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	for i := 0; i < conf.GameVotingRound; i++ {
+		leader := <-rec.startPick
+		s := game.Snapshot()
+		for j := 0; j < s.Config.NMembers[0]; j++ {
+			if err := game.Pick(ctx, leader.ID, s.Players[j].ID); err != nil {
+				t.Fatalf("Pick: %s", err)
+			}
+		}
+		if err := game.DonePick(ctx, leader.ID); err != nil {
+			t.Fatalf("DonePick: %s", err)
+		}
+		<-rec.startVoting
+		for _, player := range s.Players {
+			if err := game.Vote(ctx, player.ID, false); err != nil {
+				t.Fatalf("Vote: %s", err)
+			}
+		}
+		if i < conf.GameVotingRound-1 {
+			<-rec.votingDone
+		}
+	}
+
+	s := <-rec.over
+	// The last vote was sent before the spy win
+	select {
+	case majority := <-rec.votingDone:
+		if majority {
+			t.Errorf("the last team was approved")
+		}
+	default:
+		t.Errorf("the spy win was sent before the result of the last vote")
+	}
+	if s.State != STATE_IDLE || !s.SpyWin() {
+		t.Errorf("game ended in %s, spy win %v", s.State, s.SpyWin())
+	}
+}
+
+func TestRematch(t *testing.T) {
+	game := newTestGame(t, "test-rematch", 6, newRecorder())
+	previous := game.Snapshot()
+	game.Abort(ctx, "system")
+
+	rec := newRecorder()
+	rematch := NewRematch("test-rematch", previous, true, rec)
+	defer rematch.Abort(ctx, "system")
+	s := rematch.Snapshot()
+	if s.NPlayers != 6 || len(s.Unconfirmed) != 6 || s.Players[0].ID != playerID(1) || s.Players[5].ID != playerID(0) {
+		t.Fatalf("rematch starts with %d players (%d unconfirmed), %s first", s.NPlayers, len(s.Unconfirmed), s.Players[0].ID)
+	}
+
+	// Not confirming leaves a player free to play elsewhere
+	other := NewGame("test-rematch-other", newRecorder())
+	defer other.Abort(ctx, "system")
+	if err := other.AddPlayer(ctx, &Player{ID: playerID(0), Name: playerID(0)}); err != nil {
+		t.Fatalf("unconfirmed %s joining another game: %s", playerID(0), err)
+	}
+	if err := rematch.AddPlayer(ctx, &Player{ID: playerID(0), Name: playerID(0)}); err == nil {
+		t.Errorf("%s confirmed while playing another game", playerID(0))
+	}
+
+	for i := 1; i < 6; i++ {
+		if err := rematch.AddPlayer(ctx, &Player{ID: playerID(i), Name: playerID(i)}); err != nil {
+			t.Fatalf("confirming %s: %s", playerID(i), err)
+		}
+		if i != 2 {
+			continue
+		}
+		// A failed start leaves those still to confirm in the game
+		if err := rematch.Start(ctx, playerID(3)); err == nil {
+			t.Errorf("%s started the game before confirming", playerID(3))
+		}
+		if err := rematch.Start(ctx, playerID(1)); err == nil {
+			t.Errorf("Start with two confirmed players succeeded")
+		}
+		if s := rematch.Snapshot(); s.NPlayers != 6 || len(s.Unconfirmed) != 4 {
+			t.Errorf("failed start left %d players, %d unconfirmed", s.NPlayers, len(s.Unconfirmed))
+		}
+	}
+	if err := rematch.AddPlayer(ctx, &Player{ID: playerID(1), Name: playerID(1)}); err == nil {
+		t.Errorf("%s confirmed twice", playerID(1))
+	}
+	if err := rematch.Start(ctx, playerID(1)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	if leader := <-rec.startPick; leader.ID != playerID(1) {
+		t.Errorf("first leader is %s, expected %s", leader.ID, playerID(1))
+	}
+	s = rematch.Snapshot()
+	if s.NPlayers != 5 || s.FindPlayerByID(playerID(0)) != nil || len(s.Unconfirmed) != 0 {
+		t.Errorf("unconfirmed player was not dropped: %d players", s.NPlayers)
+	}
+	for i, player := range s.Players {
+		if player.ID != playerID(i+1) {
+			t.Errorf("seat %d is %s, expected %s", i, player.ID, playerID(i+1))
+		}
+	}
+	if games := GamesByPlayer(playerID(0)); len(games) != 1 || games[0] != other {
+		t.Errorf("dropped player is registered in %d games", len(games))
+	}
+}
+
+func TestRematchFullGame(t *testing.T) {
+	game := newTestGame(t, "test-rematch-full", conf.GameMaxPlayers, newRecorder())
+	previous := game.Snapshot()
+	game.Abort(ctx, "system")
+
+	rematch := NewRematch("test-rematch-full", previous, false, newRecorder())
+	defer rematch.Abort(ctx, "system")
+	for i := 0; i < conf.GameMaxPlayers; i++ {
+		if err := rematch.AddPlayer(ctx, &Player{ID: playerID(i), Name: playerID(i)}); err != nil {
+			t.Fatalf("confirming %s: %s", playerID(i), err)
+		}
+	}
+	if s := rematch.Snapshot(); s.NPlayers != conf.GameMaxPlayers || len(s.Unconfirmed) != 0 {
+		t.Errorf("rematch has %d players, %d unconfirmed", s.NPlayers, len(s.Unconfirmed))
+	}
+	if err := rematch.AddPlayer(ctx, &Player{ID: "stranger", Name: "stranger"}); err == nil {
+		t.Errorf("a stranger joined a full rematch")
+	}
+}
+
+func TestReadyAndExtend(t *testing.T) {
+	rec := newRecorder()
+	game := newTestGame(t, "test-ready", 5, rec)
+	defer game.Abort(ctx, "system")
+
+	for i := 0; i < 4; i++ {
+		if err := game.Ready(ctx, playerID(i)); err != nil {
+			t.Fatalf("Ready: %s", err)
+		}
+	}
+	if err := game.Ready(ctx, playerID(0)); err == nil {
+		t.Errorf("%s was ready twice", playerID(0))
+	}
+	if err := game.Ready(ctx, "stranger"); err == nil {
+		t.Errorf("a stranger was ready")
+	}
+
+	if err := game.Extend(ctx, "stranger"); err == nil {
+		t.Errorf("a stranger extended the lobby")
+	}
+	for i := 0; i < conf.GameLobbyExtensions; i++ {
+		if err := game.Extend(ctx, playerID(0)); err != nil {
+			t.Fatalf("Extend: %s", err)
+		}
+	}
+	if err := game.Extend(ctx, playerID(0)); err == nil {
+		t.Errorf("lobby extended more than %d times", conf.GameLobbyExtensions)
+	}
+	if s := game.Snapshot(); s.State != STATE_INITIALIZED || len(s.Ready) != 4 {
+		t.Fatalf("game is in state %s with %d players ready after extending", s.State, len(s.Ready))
+	}
+
+	// The last one to be ready starts the game
+	if err := game.Ready(ctx, playerID(4)); err != nil {
+		t.Fatalf("Ready: %s", err)
+	}
+	within(t, 5*time.Second, "auto-start", func() { <-rec.startPick })
+}
+
+func TestKickStartsReadyLobby(t *testing.T) {
+	rec := newRecorder()
+	game := newTestGame(t, "test-ready-kick", 6, rec)
+	defer game.Abort(ctx, "system")
+
+	for i := 0; i < 5; i++ {
+		if err := game.Ready(ctx, playerID(i)); err != nil {
+			t.Fatalf("Ready: %s", err)
+		}
+	}
+	if err := game.Unreachable(ctx, playerID(5)); err != nil {
+		t.Fatalf("Unreachable: %s", err)
+	}
+	if s := game.Snapshot(); s.State != STATE_INITIALIZED {
+		t.Fatalf("game started with %s not ready", playerID(5))
+	}
+
+	// Everyone left is ready once the only one who wasn't is kicked
+	if err := game.Kick(ctx, playerID(0)); err != nil {
+		t.Fatalf("Kick: %s", err)
+	}
+	within(t, 5*time.Second, "auto-start", func() { <-rec.startPick })
+}
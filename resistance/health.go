@@ -0,0 +1,124 @@
+package resistance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azaky/resistancebot/logging"
+)
+
+// Health serves the probes of the load balancer:
+//
+//	GET /healthz  the game daemons answer
+//	GET /readyz   the above, plus checkpoints can be saved and the outbox
+//	              is not backed up
+//
+// Both answer 200 when every check passes and 503 otherwise, with the
+// result of each check.
+type Health struct {
+	store      Store
+	outbox     interface{ Pending() int }
+	timeout    time.Duration
+	maxPending int
+}
+
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+type healthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]*healthCheck `json:"checks"`
+}
+
+func NewHealth(store Store, outbox interface{ Pending() int }) *Health {
+	return &Health{
+		store:      store,
+		outbox:     outbox,
+		timeout:    time.Duration(conf.HealthTimeout) * time.Second,
+		maxPending: conf.HealthMaxPending,
+	}
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), h.timeout)
+	defer cancel()
+
+	report := &healthReport{
+		Status: "ok",
+		Checks: map[string]*healthCheck{
+			"games": h.checkGames(ctx),
+		},
+	}
+	switch req.URL.Path {
+	case "/healthz":
+	case "/readyz":
+		report.Checks["store"] = h.checkStore()
+		report.Checks["outbox"] = h.checkOutbox()
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	status := http.StatusOK
+	for name, check := range report.Checks {
+		if !check.OK {
+			logging.With("component", "health").Warnf("Check %s failed: %s", name, check.Message)
+			report.Status = "fail"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// checkGames pings every game daemon at once, and lists the ones that don't
+// answer before ctx is done.
+func (h *Health) checkGames(ctx context.Context) *healthCheck {
+	list := ListGames()
+	var lock sync.Mutex
+	var stuck []string
+	var wg sync.WaitGroup
+	for _, game := range list {
+		wg.Add(1)
+		go func(game *Game) {
+			defer wg.Done()
+			// A game that just ended is fine
+			if err := game.Ping(ctx); err != nil && err != ErrGameOver {
+				lock.Lock()
+				stuck = append(stuck, game.ID)
+				lock.Unlock()
+			}
+		}(game)
+	}
+	wg.Wait()
+
+	if len(stuck) > 0 {
+		sort.Strings(stuck)
+		return &healthCheck{false, fmt.Sprintf("%d of %d games did not answer: %s", len(stuck), len(list), strings.Join(stuck, ", "))}
+	}
+	return &healthCheck{true, fmt.Sprintf("%d games answered", len(list))}
+}
+
+func (h *Health) checkStore() *healthCheck {
+	if err := h.store.Check(); err != nil {
+		return &healthCheck{false, err.Error()}
+	}
+	return &healthCheck{true, "writable"}
+}
+
+func (h *Health) checkOutbox() *healthCheck {
+	pending := h.outbox.Pending()
+	if pending > h.maxPending {
+		return &healthCheck{false, fmt.Sprintf("%d messages pending, more than %d", pending, h.maxPending)}
+	}
+	return &healthCheck{true, fmt.Sprintf("%d messages pending", pending)}
+}
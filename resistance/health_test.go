@@ -0,0 +1,88 @@
+package resistance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeOutbox int
+
+func (f fakeOutbox) Pending() int {
+	return int(f)
+}
+
+func probe(t *testing.T, h *Health, path string) (int, *healthReport) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code == http.StatusNotFound {
+		return w.Code, nil
+	}
+	var report healthReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("%s returned invalid JSON: %s", path, err)
+	}
+	return w.Code, &report
+}
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHealth(store, fakeOutbox(0))
+	h.timeout = 200 * time.Millisecond
+
+	// A game pausing between phases still answers
+	phaseDelay = time.Hour
+	game := newTestGame(t, "test-health", 5, newRecorder())
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	if err := game.Pick(ctx, game.Snapshot().leader().ID, playerID(0)); err != rejections[cmdPick] {
+		t.Errorf("Pick before the phase is announced returned %v", err)
+	}
+	if code, report := probe(t, h, "/healthz"); code != http.StatusOK || report.Status != "ok" {
+		t.Errorf("/healthz with a pausing game returned %d: %+v", code, report)
+	}
+	game.Abort(ctx, "system")
+	phaseDelay = 0
+
+	code, report := probe(t, h, "/readyz")
+	if code != http.StatusOK || !report.Checks["store"].OK || !report.Checks["outbox"].OK {
+		t.Errorf("/readyz returned %d: %+v", code, report)
+	}
+
+	h.outbox = fakeOutbox(h.maxPending + 1)
+	if code, report := probe(t, h, "/readyz"); code != http.StatusServiceUnavailable || report.Checks["outbox"].OK {
+		t.Errorf("/readyz with a backed up outbox returned %d: %+v", code, report)
+	}
+	// Liveness doesn't care about the outbox
+	if code, _ := probe(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz with a backed up outbox returned %d", code)
+	}
+
+	stuck := stuckHandler{unblock: make(chan struct{})}
+	stuckGame := NewGame("test-health-stuck", stuck)
+	code, report = probe(t, h, "/healthz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(report.Checks["games"].Message, "test-health-stuck") {
+		t.Errorf("/healthz with a stuck game returned %d: %+v", code, report)
+	}
+	stuckGame.Kill()
+	close(stuck.unblock)
+	<-stuckGame.done
+
+	if code, _ := probe(t, h, "/other"); code != http.StatusNotFound {
+		t.Errorf("/other returned %d", code)
+	}
+}
@@ -0,0 +1,54 @@
+package resistance
+
+import (
+	"context"
+
+	"github.com/azaky/resistancebot/util"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// newHistoryMessage lists the teams voted on so far in game, with the
+// outcome of their missions.
+func newHistoryMessage(game *Snapshot) historyMessage {
+	var data historyMessage
+	for _, p := range game.Proposals {
+		approve, reject, notVoted := p.Voters(game.Players)
+		view := proposalView{
+			Round:       p.Round,
+			VotingRound: p.VotingRound,
+			Leader:      p.Leader.Name,
+			Team:        playerNames(p.Team),
+			Approve:     playerNames(approve),
+			Reject:      playerNames(reject),
+			NotVoted:    playerNames(notVoted),
+			Approved:    p.Approved,
+		}
+		if p.Approved {
+			for i, mission := range game.Missions {
+				running := game.State == STATE_MISSION && i == len(game.Missions)-1
+				if mission.Round == p.Round && !running {
+					view.MissionDone = true
+					view.MissionSuccess = mission.Success
+					view.NFail = mission.NFail()
+				}
+			}
+		}
+		data.Proposals = append(data.Proposals, view)
+	}
+	return data
+}
+
+// showHistory shows the history of the game in the group, or of the game
+// the user plays in when sent in private chat.
+func (b *LineBot) showHistory(ctx context.Context, event *linebot.Event, args ...string) {
+	var game *Game
+	if event.Source.Type == linebot.EventSourceTypeUser {
+		if game = b.playerGame(event); game == nil {
+			return
+		}
+	} else if game = LoadGame(util.GetGameID(event.Source)); game == nil {
+		b.reply(event, `No game is created. Type ".create" to create a new game`)
+		return
+	}
+	b.reply(event, b.templates.render("history", newHistoryMessage(game.Snapshot())))
+}
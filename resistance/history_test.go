@@ -0,0 +1,79 @@
+package resistance
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHistoryMessage(t *testing.T) {
+	var p []*Player
+	for i := 0; i < 5; i++ {
+		p = append(p, &Player{ID: playerID(i), Name: playerID(i)})
+	}
+	failed := &Mission{Round: 1, Members: []*Player{p[1], p[2]}, Votes: map[string]bool{p[1].ID: true, p[2].ID: false}, MinFail: 1}
+	failed.Execute()
+	running := &Mission{Round: 2, Members: []*Player{p[2], p[3], p[4]}, Votes: map[string]bool{p[2].ID: true, p[3].ID: true, p[4].ID: true}, MinFail: 1}
+	s := &Snapshot{
+		ID:       "test-history",
+		Players:  p,
+		NPlayers: 5,
+		State:    STATE_MISSION,
+		Round:    2,
+		Missions: []*Mission{failed, running},
+		Proposals: []*Proposal{
+			{Round: 1, VotingRound: 1, Leader: p[0], Team: []*Player{p[0], p[1]}, Votes: map[string]bool{p[0].ID: true, p[1].ID: false, p[2].ID: false}},
+			{Round: 1, VotingRound: 2, Leader: p[1], Team: []*Player{p[1], p[2]}, Votes: map[string]bool{p[0].ID: true, p[1].ID: true, p[2].ID: true, p[3].ID: true, p[4].ID: true}, Approved: true},
+			{Round: 2, VotingRound: 1, Leader: p[2], Team: []*Player{p[2], p[3], p[4]}, Votes: map[string]bool{p[2].ID: true, p[3].ID: true, p[4].ID: true}, Approved: true},
+		},
+	}
+
+	got := newHistoryMessage(s)
+	want := historyMessage{[]proposalView{
+		{
+			Round: 1, VotingRound: 1, Leader: p[0].Name,
+			Team:     []string{p[0].Name, p[1].Name},
+			Approve:  []string{p[0].Name},
+			Reject:   []string{p[1].Name, p[2].Name},
+			NotVoted: []string{p[3].Name, p[4].Name},
+		},
+		{
+			Round: 1, VotingRound: 2, Leader: p[1].Name,
+			Team:     []string{p[1].Name, p[2].Name},
+			Approve:  []string{p[0].Name, p[1].Name, p[2].Name, p[3].Name, p[4].Name},
+			Approved: true, MissionDone: true, MissionSuccess: false, NFail: 1,
+		},
+		{
+			// Its mission is still running
+			Round: 2, VotingRound: 1, Leader: p[2].Name,
+			Team:     []string{p[2].Name, p[3].Name, p[4].Name},
+			Approve:  []string{p[2].Name, p[3].Name, p[4].Name},
+			NotVoted: []string{p[0].Name, p[1].Name},
+			Approved: true,
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nexpected %+v", got, want)
+	}
+
+	text := DefaultTemplates().render("history", got)
+	for _, line := range []string{"Rejected.", "Approved. Mission failed with 1 fail card(s).", "(did not vote: player0, player1)\nApproved."} {
+		if !strings.Contains(text, line) {
+			t.Errorf("History does not contain %q:\n%s", line, text)
+		}
+	}
+}
+
+func TestHistoryCommand(t *testing.T) {
+	b := newTestBot()
+	game := newTestGame(t, "test-history", 5, newRecorder())
+	defer game.Abort(ctx, "system")
+
+	want := DefaultTemplates().render("history", historyMessage{})
+	if replies := b.private(playerID(0), ".history"); len(replies) != 1 || replies[0] != want {
+		t.Errorf(".history replied %q, expected %q", replies, want)
+	}
+	if replies := b.private("stranger", ".history"); len(replies) != 1 || replies[0] != "You are not playing in any game" {
+		t.Errorf(".history from a stranger replied %q", replies)
+	}
+}
@@ -2,19 +2,20 @@ package resistance
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/azaky/resistancebot/logging"
 	"github.com/azaky/resistancebot/util"
 	"github.com/line/line-bot-sdk-go/linebot"
 	"github.com/patrickmn/go-cache"
 )
 
-type messageHandler func(*linebot.Event, ...string)
+type messageHandler func(context.Context, *linebot.Event, ...string)
 type pair struct {
 	Key   string
 	Value string
@@ -22,32 +23,48 @@ type pair struct {
 
 type LineBot struct {
 	client           *linebot.Client
-	textPatterns     map[*regexp.Regexp]messageHandler
+	commands         *router
 	postbackPatterns map[*regexp.Regexp]messageHandler
 	usersCache       *cache.Cache
+	templates        *Templates
+	handlers         *MultiEventHandler
+	companion        *Companion
+	outbox           *Outbox
+	// sendReply answers webhook events, it is replyNow but in tests
+	sendReply pushFunc
+	// currentGames remembers the game chosen with .mygame, for players in
+	// more than one game
+	currentGames *cache.Cache
+	// finished keeps the last finished game of each group, see report
+	finished *cache.Cache
 }
 
-func NewLineBot(client *linebot.Client) *LineBot {
+func NewLineBot(client *linebot.Client, templates *Templates) *LineBot {
+	if templates == nil {
+		templates = DefaultTemplates()
+	}
 	b := &LineBot{
 		client:           client,
-		textPatterns:     make(map[*regexp.Regexp]messageHandler),
+		commands:         newRouter(),
 		postbackPatterns: make(map[*regexp.Regexp]messageHandler),
 		usersCache:       cache.New(30*time.Minute, 60*time.Minute),
-	}
-	b.registerTextPattern(`^\s*\.echo\s*(.*)$`, b.echo)
-	b.registerTextPattern(`^\s*\.create\s*$`, b.createGame)
-	b.registerTextPattern(`^\s*\.abort\s*$`, b.abortGame)
-	b.registerTextPattern(`^\s*\.join\s*$`, b.joinGame)
-	b.registerTextPattern(`^\s*\.players?\s*$`, b.showPlayers)
-	b.registerTextPattern(`^\s*\.start\s*$`, b.startGame)
-	b.registerTextPattern(`^\s*\.info\s*$`, b.gameInfo)
-	b.registerTextPattern(`^\s*\.help\s*$`, b.showHelp)
-	b.registerTextPattern(`^\s*\.howtoplay\s*$`, b.showHowToPlay)
+		templates:        templates,
+		currentGames:     cache.New(24*time.Hour, time.Hour),
+		finished:         cache.New(7*24*time.Hour, time.Hour),
+	}
+	b.outbox = NewOutbox(b.pushNow, b.deliveryFailed)
+	b.sendReply = b.replyNow
+	b.handlers = NewMultiEventHandler(b)
+	SetReachability(b)
+	b.registerCommands()
 	b.registerPostbackPattern(`^\.join$`, b.joinGame)
-	b.registerPostbackPattern(`^\.pick:(\S+):(\S+)$`, b.pick)
-	b.registerPostbackPattern(`^\.donepick:(\S+)$`, b.donepick)
-	b.registerPostbackPattern(`^\.vote:(\S+):(\S+)$`, b.vote)
-	b.registerPostbackPattern(`^\.executemission:(\S+):(\S+)$`, b.executeMission)
+	b.registerPostbackPattern(`^\.rematch:([0-9a-f]+)(:rotate)?$`, b.rematch)
+	b.registerPostbackPattern(`^\.pick:([^:]+):([^:]+):(\d+):([0-9a-f]+)$`, b.signed(b.pick))
+	b.registerPostbackPattern(`^\.donepick:([^:]+):(\d+):([0-9a-f]+)$`, b.signed(b.donepick))
+	b.registerPostbackPattern(`^\.vote:([^:]+):(approve|reject):(\d+):([0-9a-f]+)$`, b.signed(b.vote))
+	b.registerPostbackPattern(`^\.executemission:([^:]+):(success|fail):(\d+):([0-9a-f]+)$`, b.signed(b.executeMission))
+	// Buttons sent before they were signed
+	b.registerPostbackPattern(`^\.(pick|donepick|vote|executemission):[^:]+(:[^:]+)?$`, b.expiredButton)
 
 	// Notify
 	if len(conf.LineNotifyUserID) > 0 {
@@ -57,26 +74,185 @@ func NewLineBot(client *linebot.Client) *LineBot {
 	return b
 }
 
-func (b *LineBot) registerTextPattern(regex string, handler messageHandler) {
-	r, err := regexp.Compile(regex)
-	if err != nil {
-		b.log("Error registering text pattern: %s", err.Error())
-		return
-	}
-	b.textPatterns[r] = handler
+// Subscribe registers an additional handler for the events of every game
+// created by this bot, next to the LINE renderer itself.
+func (b *LineBot) Subscribe(handler EventHandler) {
+	b.handlers.Register(handler)
+}
+
+// UseCompanion makes the bot send every player a link to their companion
+// page along with their role.
+func (b *LineBot) UseCompanion(companion *Companion) {
+	b.companion = companion
+}
+
+// registerCommands sets up the text commands. .help lists them in this
+// order.
+func (b *LineBot) registerCommands() {
+	b.commands.register(&textCommand{
+		name:    "help",
+		help:    "Show this",
+		handler: b.showHelp,
+	})
+	b.commands.register(&textCommand{
+		name:    "howtoplay",
+		help:    "Show rules of the game",
+		handler: b.showHowToPlay,
+	})
+	b.commands.register(&textCommand{
+		name:    "echo",
+		args:    []argSpec{{name: "text", kind: ARG_TEXT}},
+		help:    "Repeat after you",
+		hidden:  true,
+		handler: b.echo,
+	})
+	b.commands.register(&textCommand{
+		name:    "create",
+		help:    "Create a new game",
+		scope:   SCOPE_GROUP,
+		handler: b.createGame,
+	})
+	b.commands.register(&textCommand{
+		name:    "join",
+		help:    "Join a game",
+		scope:   SCOPE_GROUP,
+		handler: b.joinGame,
+	})
+	b.commands.register(&textCommand{
+		name:    "players",
+		aliases: []string{"player", "p"},
+		help:    "List players",
+		scope:   SCOPE_GROUP,
+		handler: b.showPlayers,
+	})
+	b.commands.register(&textCommand{
+		name:    "start",
+		help:    "Start the game",
+		scope:   SCOPE_GROUP,
+		handler: b.startGame,
+	})
+	b.commands.register(&textCommand{
+		name:    "ready",
+		help:    "Tell everyone you are ready. The game starts once all players are",
+		scope:   SCOPE_GROUP,
+		handler: b.readyPlayer,
+	})
+	b.commands.register(&textCommand{
+		name:    "extend",
+		help:    "Wait longer for players to join",
+		scope:   SCOPE_GROUP,
+		handler: b.extendLobby,
+	})
+	b.commands.register(&textCommand{
+		name:    "kick",
+		help:    "Remove players I can't send private messages to",
+		scope:   SCOPE_GROUP,
+		handler: b.kickPlayers,
+	})
+	b.commands.register(&textCommand{
+		name:    "abort",
+		help:    "Abort the game",
+		scope:   SCOPE_GROUP,
+		handler: b.abortGame,
+	})
+	b.commands.register(&textCommand{
+		name:    "info",
+		help:    "Show useful info about the game (current stage, leader, etc)",
+		scope:   SCOPE_GROUP,
+		handler: b.gameInfo,
+	})
+	b.commands.register(&textCommand{
+		name:    "history",
+		help:    "Show the teams voted on so far and how their missions went",
+		handler: b.showHistory,
+	})
+	b.commands.register(&textCommand{
+		name:    "lastgame",
+		help:    "Show the report of the last game played here",
+		scope:   SCOPE_GROUP,
+		handler: b.lastGame,
+	})
+	b.commands.register(&textCommand{
+		name:    "mygame",
+		args:    []argSpec{{name: "number", kind: ARG_INT, optional: true}},
+		help:    "Show the game you are playing, or choose which one the commands below go to",
+		scope:   SCOPE_PRIVATE,
+		handler: b.myGame,
+	})
+	// These do what the buttons do, for chats where the buttons don't show
+	b.commands.register(&textCommand{
+		name:    "pick",
+		args:    []argSpec{{name: "number", kind: ARG_INT}},
+		help:    "Choose (or drop) a player for the team, when you are the leader",
+		scope:   SCOPE_PRIVATE,
+		handler: b.pickByNumber,
+	})
+	b.commands.register(&textCommand{
+		name:    "done",
+		aliases: []string{"donepick"},
+		help:    "Send the team to vote, when you are the leader",
+		scope:   SCOPE_PRIVATE,
+		handler: b.donepickText,
+	})
+	b.commands.register(&textCommand{
+		name: "vote",
+		args: []argSpec{{name: "vote", kind: ARG_CHOICE, choices: map[string]string{
+			"yes": "yes", "y": "yes", "approve": "yes",
+			"no": "no", "n": "no", "reject": "no",
+		}}},
+		help:    "Approve or reject the team",
+		scope:   SCOPE_PRIVATE,
+		handler: b.voteText,
+	})
+	b.commands.register(&textCommand{
+		name: "mission",
+		args: []argSpec{{name: "outcome", kind: ARG_CHOICE, choices: map[string]string{
+			"success": "success", "s": "success",
+			"fail": "fail", "f": "fail",
+		}}},
+		help:    "Choose the outcome of the mission you are in",
+		scope:   SCOPE_PRIVATE,
+		handler: b.executeMissionText,
+	})
+	b.commands.register(&textCommand{
+		name: "admin",
+		args: []argSpec{
+			{name: "command", kind: ARG_WORD, optional: true},
+			{name: "args", kind: ARG_TEXT, optional: true},
+		},
+		help:    "Manage running games",
+		scope:   SCOPE_PRIVATE,
+		hidden:  true,
+		handler: b.admin,
+	})
 }
 
 func (b *LineBot) registerPostbackPattern(regex string, handler messageHandler) {
 	r, err := regexp.Compile(regex)
 	if err != nil {
-		b.log("Error registering postback pattern: %s", err.Error())
+		lineLog.Errorf("Error registering postback pattern: %s", err.Error())
 		return
 	}
 	b.postbackPatterns[r] = handler
 }
 
-func (b *LineBot) log(format string, args ...interface{}) {
-	log.Printf("[LINE] "+format, args...)
+var lineLog = logging.With("component", "line")
+
+// eventLogger returns a logger with the source of event.
+func (b *LineBot) eventLogger(event *linebot.Event) *logging.Logger {
+	fields := logging.Fields{"event": string(event.Type)}
+	if source := event.Source; source != nil {
+		if source.UserID != "" {
+			fields["user_id"] = source.UserID
+		}
+		if source.GroupID != "" {
+			fields["group_id"] = source.GroupID
+		}
+		if source.RoomID != "" {
+			fields["room_id"] = source.RoomID
+		}
+	}
+	return lineLog.WithFields(fields)
 }
 
 func (b *LineBot) reply(event *linebot.Event, messages ...string) error {
@@ -84,13 +260,22 @@ func (b *LineBot) reply(event *linebot.Event, messages ...string) error {
 	for _, message := range messages {
 		lineMessages = append(lineMessages, linebot.NewTextMessage(message))
 	}
-	_, err := b.client.ReplyMessage(event.ReplyToken, lineMessages...).Do()
+	err := b.sendReply(event.ReplyToken, lineMessages...)
 	if err != nil {
-		b.log("Error replying to %+v: %s", event.Source, err.Error())
+		b.eventLogger(event).Errorf("Error replying: %s", err.Error())
 	}
 	return err
 }
 
+// replyNow answers with the reply token of an event. Reply tokens expire
+// quickly, so replies are not queued like pushes.
+func (b *LineBot) replyNow(replyToken string, messages ...linebot.Message) error {
+	start := time.Now()
+	_, err := b.client.ReplyMessage(replyToken, messages...).Do()
+	observeLineCall("reply", start, err)
+	return err
+}
+
 func (b *LineBot) replyPostback(event *linebot.Event, title, text string, data ...pair) error {
 	var actions []linebot.TemplateAction
 	for _, p := range data {
@@ -111,34 +296,70 @@ func (b *LineBot) replyPostback(event *linebot.Event, title, text string, data .
 				linebot.NewButtonsTemplate("", title, text, actions[i:i+4]...)))
 		}
 	}
-	_, err := b.client.ReplyMessage(event.ReplyToken, messages...).Do()
+	err := b.sendReply(event.ReplyToken, messages...)
 	if err != nil {
-		b.log("Error replying postback to %+v: %s", event.Source, err.Error())
+		b.eventLogger(event).Errorf("Error replying postback: %s", err.Error())
 	}
 	return err
 }
 
 func (b *LineBot) replyRaw(event *linebot.Event, lineMessages ...linebot.Message) error {
-	_, err := b.client.ReplyMessage(event.ReplyToken, lineMessages...).Do()
+	err := b.sendReply(event.ReplyToken, lineMessages...)
+	if err != nil {
+		b.eventLogger(event).Errorf("Error replying: %s", err.Error())
+	}
+	return err
+}
+
+// pushNow sends messages right away. Everything else goes through the
+// outbox, see push.
+func (b *LineBot) pushNow(to string, messages ...linebot.Message) error {
+	start := time.Now()
+	_, err := b.client.PushMessage(to, messages...).Do()
+	observeLineCall("push", start, err)
 	if err != nil {
-		b.log("Error replying to %+v: %s", event.Source, err.Error())
+		lineLog.With("to", to).Warnf("Error pushing: %s", err.Error())
 	}
 	return err
 }
 
-func (b *LineBot) push(to string, messages ...string) error {
+// deliveryFailed tells the games of to that it can't be reached, typically
+// because they haven't added the bot as friend, see OnUnreachable.
+func (b *LineBot) deliveryFailed(to string, err error) {
+	lineLog.With("to", to).Errorf("Giving up pushing: %s", err.Error())
+	b.usersCache.Delete(to)
+	for _, game := range GamesByPlayer(to) {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		if err := game.Unreachable(ctx, to); err != nil && err != ErrGameOver {
+			lineLog.With("to", to).With("game_id", game.ID).Warnf("Error marking player unreachable: %s", err.Error())
+		}
+		cancel()
+	}
+}
+
+func (b *LineBot) OnUnreachable(game *Snapshot, player *Player) {
+	b.push(game.ID, b.templates.render("undeliverable", playerMessage{player.Name}))
+}
+
+// Pending returns the number of pushed messages not delivered yet.
+func (b *LineBot) Pending() int {
+	return b.outbox.Pending()
+}
+
+// Flush waits until all pushed messages are delivered, see Outbox.Flush.
+func (b *LineBot) Flush(ctx context.Context) error {
+	return b.outbox.Flush(ctx)
+}
+
+func (b *LineBot) push(to string, messages ...string) {
 	var lineMessages []linebot.Message
 	for _, message := range messages {
 		lineMessages = append(lineMessages, linebot.NewTextMessage(message))
 	}
-	_, err := b.client.PushMessage(to, lineMessages...).Do()
-	if err != nil {
-		b.log("Error pushing to %s: %s", to, err.Error())
-	}
-	return err
+	b.outbox.Push(to, lineMessages...)
 }
 
-func (b *LineBot) pushPostback(to string, title, text string, data ...pair) error {
+func (b *LineBot) pushPostback(to string, title, text string, data ...pair) {
 	var actions []linebot.TemplateAction
 	for _, p := range data {
 		key := p.Key
@@ -158,14 +379,10 @@ func (b *LineBot) pushPostback(to string, title, text string, data ...pair) erro
 				linebot.NewButtonsTemplate("", title, text, actions[i:i+4]...)))
 		}
 	}
-	_, err := b.client.PushMessage(to, messages...).Do()
-	if err != nil {
-		b.log("Error pushing postback to %+v: %s", to, err.Error())
-	}
-	return err
+	b.outbox.Push(to, messages...)
 }
 
-func (b *LineBot) pushTextback(to string, title, text string, data ...pair) error {
+func (b *LineBot) pushTextback(to string, title, text string, data ...pair) {
 	var actions []linebot.TemplateAction
 	for _, p := range data {
 		key := p.Key
@@ -185,11 +402,7 @@ func (b *LineBot) pushTextback(to string, title, text string, data ...pair) erro
 				linebot.NewButtonsTemplate("", title, text, actions[i:i+4]...)))
 		}
 	}
-	_, err := b.client.PushMessage(to, messages...).Do()
-	if err != nil {
-		b.log("Error pushing postback to %+v: %s", to, err.Error())
-	}
-	return err
+	b.outbox.Push(to, messages...)
 }
 
 func (b *LineBot) warnIncompatibility(event *linebot.Event) error {
@@ -212,7 +425,9 @@ func (b *LineBot) getUserInfo(source *linebot.EventSource) (*linebot.UserProfile
 	}
 
 	// get info from line
+	start := time.Now()
 	res, err := b.client.GetProfile(source.UserID).Do()
+	observeLineCall("profile", start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -232,8 +447,14 @@ func (b *LineBot) EventHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	requestID := logging.NewRequestID()
 	for _, event := range events {
-		b.log("[EVENT][%s] Source: %#v", event.Type, event.Source)
+		// Handlers outlive the request, so their context must not be
+		// cancelled with it
+		l := b.eventLogger(event).With("request_id", requestID)
+		ctx := logging.NewContext(context.Background(), l)
+		l.Infof("Received %s event", event.Type)
+		webhookEvents.WithLabelValues(string(event.Type)).Inc()
 		switch event.Type {
 
 		case linebot.EventTypeJoin:
@@ -250,11 +471,11 @@ func (b *LineBot) EventHandler(w http.ResponseWriter, req *http.Request) {
 		case linebot.EventTypeMessage:
 			switch message := event.Message.(type) {
 			case *linebot.TextMessage:
-				go b.handleTextMessage(event, message)
+				go b.handleTextMessage(ctx, event, message)
 			}
 
 		case linebot.EventTypePostback:
-			go b.handlePostback(event, event.Postback)
+			go b.handlePostback(ctx, event, event.Postback)
 		}
 	}
 }
@@ -264,58 +485,74 @@ func (b *LineBot) handleJoin(event *linebot.Event) {
 }
 
 func (b *LineBot) handleFollow(event *linebot.Event) {
+	if len(GamesByPlayer(event.Source.UserID)) > 0 {
+		// Back in time for their game, e.g. after being asked to add me
+		// by .start
+		b.reply(event, `Thanks for adding me! Type ".mygame" to see the game you are playing`)
+		return
+	}
 	b.reply(event, `Thanks for adding me! Invite me to group chats to play`)
 }
 
 func (b *LineBot) handleUnfollow(event *linebot.Event) {
-	// do some cleanup perhaps (?)
+	if event.Source.Type == linebot.EventSourceTypeUser {
+		// They can't get private messages anymore, make the next .join
+		// check again
+		b.usersCache.Delete(event.Source.UserID)
+	}
 }
 
-func (b *LineBot) handleTextMessage(event *linebot.Event, message *linebot.TextMessage) {
-	b.log("[MESSAGE] %+v: %s", event.Source, message.Text)
-	for regex, handler := range b.textPatterns {
-		matches := regex.FindStringSubmatch(message.Text)
-		if matches != nil {
-			handler(event, matches...)
-			return
+func (b *LineBot) handleTextMessage(ctx context.Context, event *linebot.Event, message *linebot.TextMessage) {
+	logging.FromContext(ctx).Debugf("Message: %s", message.Text)
+	command, args, err := b.commands.route(message.Text)
+	if command == nil {
+		return
+	}
+	if !inScope(command.scope, event.Source) {
+		if !command.hidden {
+			b.reply(event, scopeErrors[command.scope])
 		}
+		return
+	}
+	if err != nil {
+		if !command.hidden {
+			b.reply(event, err.Error())
+		}
+		return
 	}
+	command.handler(ctx, event, args...)
 }
 
-func (b *LineBot) handlePostback(event *linebot.Event, postback *linebot.Postback) {
-	b.log("[POSTBACK] %+v: %s", event.Source, postback.Data)
+func inScope(scope commandScope, source *linebot.EventSource) bool {
+	switch scope {
+	case SCOPE_GROUP:
+		return source.Type != linebot.EventSourceTypeUser
+	case SCOPE_PRIVATE:
+		return source.Type == linebot.EventSourceTypeUser
+	}
+	return true
+}
+
+func (b *LineBot) handlePostback(ctx context.Context, event *linebot.Event, postback *linebot.Postback) {
+	logging.FromContext(ctx).Debugf("Postback: %s", postback.Data)
 	for regex, handler := range b.postbackPatterns {
 		matches := regex.FindStringSubmatch(postback.Data)
 		if matches != nil {
-			handler(event, matches...)
+			handler(ctx, event, matches...)
 			return
 		}
 	}
 }
 
-func (b *LineBot) echo(event *linebot.Event, args ...string) {
+func (b *LineBot) echo(ctx context.Context, event *linebot.Event, args ...string) {
 	b.reply(event, args[1])
 }
 
-func (b *LineBot) showHelp(event *linebot.Event, args ...string) {
-	var buffer bytes.Buffer
-	buffer.WriteString("List of commands:")
-	buffer.WriteString("\n")
-	buffer.WriteString("\nGlobal:")
-	buffer.WriteString("\n.help : Show this")
-	buffer.WriteString("\n.howtoplay : Show rules of the game")
-	buffer.WriteString("\n")
-	buffer.WriteString("\nIn Game:")
-	buffer.WriteString("\n.create : Create a new game")
-	buffer.WriteString("\n.join : Join a game")
-	buffer.WriteString("\n.players : List players")
-	buffer.WriteString("\n.abort : Abort the game")
-	buffer.WriteString("\n.info : Show useful info about the game (current stage, leader, etc)")
-
-	b.reply(event, buffer.String())
+func (b *LineBot) showHelp(ctx context.Context, event *linebot.Event, args ...string) {
+	b.reply(event, b.commands.help())
 }
 
-func (b *LineBot) showHowToPlay(event *linebot.Event, args ...string) {
+func (b *LineBot) showHowToPlay(ctx context.Context, event *linebot.Event, args ...string) {
 	var buffer bytes.Buffer
 	buffer.WriteString("How to Play")
 	buffer.WriteString("\n")
@@ -341,12 +578,39 @@ func (b *LineBot) getPlayerFromUser(user *linebot.UserProfileResponse) *Player {
 	}
 }
 
-func (b *LineBot) createGame(event *linebot.Event, args ...string) {
-	if event.Source.Type == linebot.EventSourceTypeUser {
-		b.reply(event, "Cannot create game here. Create one in group/multichat")
+// command runs a game command on behalf of a webhook event. Most failures
+// are already reported to the players through the event handlers, so they
+// are only logged at debug level.
+func (b *LineBot) command(ctx context.Context, id string, f func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	l := logging.FromContext(ctx).With("game_id", id)
+	err := f(ctx)
+	if err == context.DeadlineExceeded {
+		l.Warnf("Game did not answer in %s", commandTimeout)
+	} else if err != nil {
+		l.Debugf("Command failed: %s", err.Error())
+	}
+	return err
+}
+
+// privateCommand is command for the text commands sent in private chat.
+// Unlike a button, a typed command can come at any time, so the user is
+// told when the game doesn't take it now.
+func (b *LineBot) privateCommand(ctx context.Context, event *linebot.Event, f func(ctx context.Context, game *Game) error) {
+	game := b.playerGame(event)
+	if game == nil {
 		return
 	}
+	err := b.command(ctx, game.ID, func(ctx context.Context) error {
+		return f(ctx, game)
+	})
+	if rejected(err) {
+		b.reply(event, err.Error())
+	}
+}
 
+func (b *LineBot) createGame(ctx context.Context, event *linebot.Event, args ...string) {
 	user, err := b.getUserInfo(event.Source)
 	if err != nil {
 		b.warnIncompatibility(event)
@@ -360,11 +624,13 @@ func (b *LineBot) createGame(event *linebot.Event, args ...string) {
 		return
 	}
 
-	game := NewGame(id, b)
-	game.AddPlayer(b.getPlayerFromUser(user))
+	game := NewGame(id, b.handlers)
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.AddPlayer(ctx, b.getPlayerFromUser(user))
+	})
 }
 
-func (b *LineBot) joinGame(event *linebot.Event, args ...string) {
+func (b *LineBot) joinGame(ctx context.Context, event *linebot.Event, args ...string) {
 	if event.Source.Type == linebot.EventSourceTypeUser {
 		// don't bother reply
 		return
@@ -378,24 +644,37 @@ func (b *LineBot) joinGame(event *linebot.Event, args ...string) {
 
 	id := util.GetGameID(event.Source)
 
-	if !GameExistsByID(id) {
+	game := LoadGame(id)
+	if game == nil {
 		// Auto-create game if not exist
 		b.reply(event, `No game to join. Creating a new game ...`)
-		game := NewGame(id, b)
-		game.AddPlayer(b.getPlayerFromUser(user))
+		game = NewGame(id, b.handlers)
+	}
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.AddPlayer(ctx, b.getPlayerFromUser(user))
+	})
+}
+
+func (b *LineBot) startGame(ctx context.Context, event *linebot.Event, args ...string) {
+	user, err := b.getUserInfo(event.Source)
+	if err != nil {
+		b.warnIncompatibility(event)
 		return
 	}
 
-	game := LoadGame(id)
-	game.AddPlayer(b.getPlayerFromUser(user))
-}
+	id := util.GetGameID(event.Source)
 
-func (b *LineBot) startGame(event *linebot.Event, args ...string) {
-	if event.Source.Type == linebot.EventSourceTypeUser {
-		// don't bother reply
+	game := LoadGame(id)
+	if game == nil {
+		b.reply(event, `No game is created. Type ".create" to create a new game`)
 		return
 	}
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.Start(ctx, user.UserID)
+	})
+}
 
+func (b *LineBot) kickPlayers(ctx context.Context, event *linebot.Event, args ...string) {
 	user, err := b.getUserInfo(event.Source)
 	if err != nil {
 		b.warnIncompatibility(event)
@@ -404,37 +683,52 @@ func (b *LineBot) startGame(event *linebot.Event, args ...string) {
 
 	id := util.GetGameID(event.Source)
 
-	if !GameExistsByID(id) {
-		b.reply(event, `No game is created. Type ".create" to create a new game`)
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
-
-	game := LoadGame(id)
-	game.Start(user.UserID)
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.Kick(ctx, user.UserID)
+	})
 }
 
-func (b *LineBot) gameInfo(event *linebot.Event, args ...string) {
-	if event.Source.Type == linebot.EventSourceTypeUser {
-		// don't bother reply
+func (b *LineBot) readyPlayer(ctx context.Context, event *linebot.Event, args ...string) {
+	id := util.GetGameID(event.Source)
+
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.Ready(ctx, event.Source.UserID)
+	})
+}
 
+func (b *LineBot) extendLobby(ctx context.Context, event *linebot.Event, args ...string) {
 	id := util.GetGameID(event.Source)
 
-	if !GameExistsByID(id) {
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
-
-	game := LoadGame(id)
-	game.Info()
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.Extend(ctx, event.Source.UserID)
+	})
 }
 
-func (b *LineBot) abortGame(event *linebot.Event, args ...string) {
-	if event.Source.Type == linebot.EventSourceTypeUser {
-		// don't bother reply
+func (b *LineBot) gameInfo(ctx context.Context, event *linebot.Event, args ...string) {
+	id := util.GetGameID(event.Source)
+
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.Info(ctx)
+	})
+}
 
+func (b *LineBot) abortGame(ctx context.Context, event *linebot.Event, args ...string) {
 	user, err := b.getUserInfo(event.Source)
 	if err != nil {
 		b.warnIncompatibility(event)
@@ -443,125 +737,163 @@ func (b *LineBot) abortGame(event *linebot.Event, args ...string) {
 
 	id := util.GetGameID(event.Source)
 
-	if !GameExistsByID(id) {
-		return
-	}
-
 	game := LoadGame(id)
-	game.Abort(user.UserID)
-}
-
-func (b *LineBot) showPlayers(event *linebot.Event, args ...string) {
-	if event.Source.Type == linebot.EventSourceTypeUser {
-		// don't bother reply
+	if game == nil {
 		return
 	}
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.Abort(ctx, user.UserID)
+	})
+}
 
+func (b *LineBot) showPlayers(ctx context.Context, event *linebot.Event, args ...string) {
 	id := util.GetGameID(event.Source)
 
-	if !GameExistsByID(id) {
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
-
-	game := LoadGame(id)
-	game.ShowPlayers()
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.ShowPlayers(ctx)
+	})
 }
 
-func (b *LineBot) pick(event *linebot.Event, args ...string) {
+func (b *LineBot) pick(ctx context.Context, event *linebot.Event, args ...string) {
 	id := args[1]
 
-	if !GameExistsByID(id) {
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
-
-	game := LoadGame(id)
-	game.Pick(event.Source.UserID, args[2])
+	b.buttonCommand(ctx, event, id, func(ctx context.Context) error {
+		return game.Pick(ctx, event.Source.UserID, args[2])
+	})
 }
 
-func (b *LineBot) donepick(event *linebot.Event, args ...string) {
+func (b *LineBot) donepick(ctx context.Context, event *linebot.Event, args ...string) {
 	id := args[1]
 
-	if !GameExistsByID(id) {
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
-
-	game := LoadGame(id)
-	game.DonePick(event.Source.UserID)
+	b.buttonCommand(ctx, event, id, func(ctx context.Context) error {
+		return game.DonePick(ctx, event.Source.UserID)
+	})
 }
 
-func (b *LineBot) vote(event *linebot.Event, args ...string) {
+func (b *LineBot) vote(ctx context.Context, event *linebot.Event, args ...string) {
 	if len(args) < 3 {
 		return
 	}
 	id := args[1]
 	vote := args[2] == "approve"
 
-	if !GameExistsByID(id) {
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
-
-	game := LoadGame(id)
-	game.Vote(event.Source.UserID, vote)
+	b.buttonCommand(ctx, event, id, func(ctx context.Context) error {
+		return game.Vote(ctx, event.Source.UserID, vote)
+	})
 }
 
-func (b *LineBot) executeMission(event *linebot.Event, args ...string) {
+func (b *LineBot) executeMission(ctx context.Context, event *linebot.Event, args ...string) {
 	if len(args) < 3 {
 		return
 	}
 	id := args[1]
 	vote := args[2] == "success"
 
-	if !GameExistsByID(id) {
+	game := LoadGame(id)
+	if game == nil {
 		return
 	}
+	b.buttonCommand(ctx, event, id, func(ctx context.Context) error {
+		return game.ExecuteMission(ctx, event.Source.UserID, vote)
+	})
+}
 
-	game := LoadGame(id)
-	game.ExecuteMission(event.Source.UserID, vote)
+func (b *LineBot) pickByNumber(ctx context.Context, event *linebot.Event, args ...string) {
+	number, _ := strconv.Atoi(args[1])
+	b.privateCommand(ctx, event, func(ctx context.Context, game *Game) error {
+		players := game.Snapshot().Players
+		if number < 1 || number > len(players) {
+			b.reply(event, fmt.Sprintf("Choose a number between 1 and %d", len(players)))
+			return nil
+		}
+		return game.Pick(ctx, event.Source.UserID, players[number-1].ID)
+	})
 }
 
-func (b *LineBot) OnCreate(game *Game) {
+func (b *LineBot) donepickText(ctx context.Context, event *linebot.Event, args ...string) {
+	b.privateCommand(ctx, event, func(ctx context.Context, game *Game) error {
+		return game.DonePick(ctx, event.Source.UserID)
+	})
+}
+
+func (b *LineBot) voteText(ctx context.Context, event *linebot.Event, args ...string) {
+	vote := args[1] == "yes"
+	b.privateCommand(ctx, event, func(ctx context.Context, game *Game) error {
+		return game.Vote(ctx, event.Source.UserID, vote)
+	})
+}
+
+func (b *LineBot) executeMissionText(ctx context.Context, event *linebot.Event, args ...string) {
+	success := args[1] == "success"
+	b.privateCommand(ctx, event, func(ctx context.Context, game *Game) error {
+		return game.ExecuteMission(ctx, event.Source.UserID, success)
+	})
+}
+
+func (b *LineBot) OnCreate(game *Snapshot) {
+	text := b.templates.render("create", secondsMessage{conf.GameInitializationTime})
+	if len(game.Unconfirmed) > 0 {
+		text = b.templates.render("rematch", rematchMessage{playerNames(game.Players), conf.GameInitializationTime})
+	}
 	// Create a postback button to join
 	b.pushTextback(game.ID,
 		"New Game",
-		fmt.Sprintf("Game will be started in %d seconds. Commands:", conf.GameInitializationTime),
+		text,
 		pair{"Join", ".join"},
+		pair{"Ready", ".ready"},
 		pair{"Start", ".start"},
 		pair{"Abort", ".abort"},
-		pair{"Show Players", ".players"},
 	)
+	b.pushTextback(game.ID, "Players", "See who has joined so far", pair{"Show Players", ".players"})
 }
 
-func (b *LineBot) OnAbort(game *Game, aborter *Player) {
+func (b *LineBot) OnAbort(game *Snapshot, aborter *Player) {
+	var data abortMessage
 	if aborter != nil {
-		b.push(game.ID, fmt.Sprintf("Game aborted by %s", aborter.Name))
-	} else {
-		b.push(game.ID, "Game aborted.")
+		data.Aborter = aborter.Name
 	}
+	b.push(game.ID, b.templates.render("abort", data))
 }
 
-func (b *LineBot) OnStart(game *Game, starter *Player, c *Config, err error) {
+func (b *LineBot) OnStart(game *Snapshot, starter *Player, c *Config, err error) {
 	if err != nil {
 		b.push(game.ID, err.Error())
 		return
 	}
 
-	var messages []string
-	if starter == nil {
-		messages = append(messages, `Game started. Check your PM to find out your role`)
-	} else {
-		messages = append(messages, fmt.Sprintf(`Game started by %s. Check your PM to find out your role`, starter.Name))
+	var data startMessage
+	if starter != nil {
+		data.Starter = starter.Name
 	}
-
-	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("There are %d resistances, and %d spies.", c.NPlayers-c.NSpies, c.NSpies))
-	buffer.WriteString(fmt.Sprintf("\n\nThere are %d missions to be executed, each requires %s members each (* means that the mission requires at least 2 fails to sabotage it)", c.NRounds, strings.Join(c.NOverview, ", ")))
-	messages = append(messages, buffer.String())
-
-	b.push(game.ID, messages...)
+	b.push(game.ID,
+		b.templates.render("start", data),
+		b.templates.render("start_config", configMessage{
+			NResistances: c.NPlayers - c.NSpies,
+			NSpies:       c.NSpies,
+			NRounds:      c.NRounds,
+			Overview:     c.NOverview,
+		}),
+	)
 
 	for _, player := range game.Players {
 		if player.Role == ROLE_RESISTANCE {
-			b.push(player.ID, fmt.Sprintf("%s, you are a Resistance. You'll win if at least 3 missions are successful.", player.Name))
+			b.push(player.ID, b.templates.render("role_resistance", roleMessage{Name: player.Name}))
 		} else {
 			var spies []string
 			for _, spy := range game.Players {
@@ -569,309 +901,339 @@ func (b *LineBot) OnStart(game *Game, starter *Player, c *Config, err error) {
 					spies = append(spies, spy.Name)
 				}
 			}
-			b.push(player.ID, fmt.Sprintf("%s, you are a Spy. You'll win if at least 3 missions are failed.\n\nThe other spies: %s", player.Name, strings.Join(spies, ", ")))
+			b.push(player.ID, b.templates.render("role_spy", roleMessage{Name: player.Name, Spies: spies}))
+		}
+		if b.companion != nil {
+			b.push(player.ID, b.templates.render("companion_link", linkMessage{b.companion.URL(game, player.ID)}))
 		}
 	}
 }
 
-func (b *LineBot) OnInfo(game *Game, c *Config) {
-	var buffer bytes.Buffer
-	buffer.WriteString("Game info:")
-	buffer.WriteString(fmt.Sprintf("\n\n%d spies, %d resistances.", c.NSpies, c.NPlayers-c.NSpies))
-
-	var overview []string
+func (b *LineBot) OnInfo(game *Snapshot, c *Config) {
+	data := infoMessage{
+		NResistances: c.NPlayers - c.NSpies,
+		NSpies:       c.NSpies,
+		Round:        game.Round,
+		VotingRound:  game.VotingRound,
+	}
 	for i, o := range c.NOverview {
 		if i == game.Round-1 {
-			overview = append(overview, "("+o+")")
+			data.Overview = append(data.Overview, "("+o+")")
 		} else {
-			overview = append(overview, o)
+			data.Overview = append(data.Overview, o)
 		}
 	}
-	buffer.WriteString(fmt.Sprintf("\n\nMission #%d, Leader #%d", game.Round, game.VotingRound))
-	buffer.WriteString(fmt.Sprintf("\nMembers required for each mission:\n%s", strings.Join(overview, ", ")))
 
 	switch game.State {
 	case STATE_PICK:
-		i := 1
-		buffer.WriteString("\n\nCurrent Stage: Leader chooses team. Current team:")
-		for _, player := range game.Picks {
-			buffer.WriteString(fmt.Sprintf("\n%d. %s", i, player.Name))
-			i++
-		}
-		if len(game.Picks) == 0 {
-			buffer.WriteString("\n(no one yet)")
-		}
+		data.Stage = "pick"
+		data.Team = playerNames(game.GetPicks())
 
 	case STATE_VOTING:
-		i := 1
-		buffer.WriteString("\n\nCurrent Stage: Vote on team:")
-		for _, player := range game.Picks {
-			buffer.WriteString(fmt.Sprintf("\n%d. %s", i, player.Name))
-			i++
-		}
+		data.Stage = "voting"
+		data.Team = playerNames(game.GetPicks())
 
 	case STATE_MISSION:
-		buffer.WriteString("\n\nCurrent Stage: Mission Execution. Members:")
-		for i, player := range game.CurrentMission().Members {
-			buffer.WriteString(fmt.Sprintf("\n%d. %s", i+1, player.Name))
-		}
+		data.Stage = "mission"
+		data.Team = playerNames(game.CurrentMission().Members)
 	}
 
-	b.push(game.ID, buffer.String())
+	b.push(game.ID, b.templates.render("info", data))
 }
 
-func (b *LineBot) OnAddPlayer(game *Game, player *Player, err error) {
+func (b *LineBot) OnAddPlayer(game *Snapshot, player *Player, err error) {
 	if err != nil {
 		b.push(game.ID, err.Error())
 	} else {
-		b.push(game.ID, fmt.Sprintf("%s is added to the game.", player.Name))
+		b.push(game.ID, b.templates.render("add_player", playerMessage{player.Name}))
 	}
 }
 
-func (b *LineBot) OnShowPlayers(game *Game, players []*Player, leaderIndex int, over bool) {
-	var buffer bytes.Buffer
+func (b *LineBot) OnDrop(game *Snapshot, players []*Player) {
+	b.push(game.ID, b.templates.render("drop", namesMessage{playerNames(players)}))
+}
+
+func (b *LineBot) OnReady(game *Snapshot, player *Player, err error) {
+	if err != nil {
+		b.push(game.ID, err.Error())
+		return
+	}
+	b.push(game.ID, b.templates.render("ready", readyMessage{player.Name, len(game.Ready), game.NPlayers}))
+}
+
+func (b *LineBot) OnExtend(game *Snapshot, player *Player, err error) {
+	if err != nil {
+		b.push(game.ID, err.Error())
+		return
+	}
+	data := extendMessage{
+		Seconds: conf.GameInitializationTime,
+		Left:    conf.GameLobbyExtensions - game.Extensions,
+		Missing: conf.GameMinPlayers - game.NPlayers,
+	}
+	if player != nil {
+		data.Name = player.Name
+	}
+	b.push(game.ID, b.templates.render("extend", data))
+}
+
+func (b *LineBot) OnKick(game *Snapshot, players []*Player, err error) {
+	if err != nil {
+		b.push(game.ID, err.Error())
+	} else {
+		b.push(game.ID, b.templates.render("kick", namesMessage{playerNames(players)}))
+	}
+}
+
+// Reachable implements Reachability. LINE only hands out the profile of
+// users who are friends with the bot, which is also who it can push to, so
+// a 404 means the user can't be reached. Cached profiles are trusted, they
+// are dropped on unfollow and on failed pushes.
+func (b *LineBot) Reachable(userID string) (bool, error) {
+	if _, ok := b.usersCache.Get(userID); ok {
+		return true, nil
+	}
+	start := time.Now()
+	res, err := b.client.GetProfile(userID).Do()
+	observeLineCall("profile", start, err)
+	if apiErr, ok := err.(*linebot.APIError); ok && apiErr.Code == http.StatusNotFound {
+		lineLog.With("user_id", userID).Infof("Player is unreachable: %s", err.Error())
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	b.usersCache.Set(userID, res, cache.DefaultExpiration)
+	return true, nil
+}
+
+func (b *LineBot) OnShowPlayers(game *Snapshot, players []*Player, leaderIndex int, over bool) {
+	var data playersMessage
+	for i, player := range players {
+		data.Players = append(data.Players, playerView{
+			Number:      i + 1,
+			Name:        player.Name,
+			Leader:      i == leaderIndex,
+			Spy:         over && player.Role == ROLE_SPY,
+			Unconfirmed: game.Unconfirmed[player.ID],
+		})
+	}
 	if !over {
-		buffer.WriteString("Players:")
-		for i, player := range players {
-			if i == leaderIndex {
-				buffer.WriteString(fmt.Sprintf("\n%d. %s (leader)", i+1, player.Name))
-			} else {
-				buffer.WriteString(fmt.Sprintf("\n%d. %s", i+1, player.Name))
-			}
-		}
+		b.push(game.ID, b.templates.render("players", data))
 	} else {
-		buffer.WriteString("Here are players and their roles:")
-		for i, player := range players {
-			if player.Role == ROLE_RESISTANCE {
-				buffer.WriteString(fmt.Sprintf("\n%d. %s (Resistance)", i+1, player.Name))
-			} else {
-				buffer.WriteString(fmt.Sprintf("\n%d. %s (Spy)", i+1, player.Name))
-			}
-		}
+		b.push(game.ID, b.templates.render("players_revealed", data))
 	}
-	b.push(game.ID, buffer.String())
 }
 
-func (b *LineBot) OnStartPick(game *Game, leader *Player) {
+func (b *LineBot) OnStartPick(game *Snapshot, leader *Player) {
 	var buttons []pair
 	for _, player := range game.Players {
-		buttons = append(buttons, pair{player.Name, ".pick:" + game.ID + ":" + player.ID})
+		buttons = append(buttons, pair{player.Name, signPostback(game, ".pick:"+game.ID+":"+player.ID)})
+	}
+	buttons = append(buttons, pair{"Done", signPostback(game, ".donepick:"+game.ID)})
+	data := pickMessage{
+		Round:       game.Round,
+		VotingRound: game.VotingRound,
+		Leader:      leader.Name,
+		Required:    game.Config.NOverview[game.Round-1],
+		Players:     playerNames(game.Players),
+	}
+	b.push(leader.ID, b.templates.render("start_pick_pm", data))
+	if len(game.Proposals) > 0 {
+		b.push(leader.ID, b.templates.render("history", newHistoryMessage(game)))
 	}
-	buttons = append(buttons, pair{"Done", ".donepick:" + game.ID})
-	b.push(leader.ID,
-		fmt.Sprintf("[Leader chooses team]\n[Mission #%d, Leader #%d]\n\nYou are the current leader. Choose people you trust the most to go for the mission. This mission needs %s people. Click \"Done\" when you're done.\n\nChoose wisely.",
-			game.Round, game.VotingRound, game.Config.NOverview[game.Round-1]))
 	b.pushPostback(leader.ID,
 		fmt.Sprintf("Mission #%d, Leader #%d", game.Round, game.VotingRound),
 		fmt.Sprintf("This mission needs %s people", game.Config.NOverview[game.Round-1]),
 		buttons...)
-	b.push(game.ID,
-		fmt.Sprintf("[Leader chooses team]\n[Mission #%d, Leader #%d]\n\nCurrent leader is %s. He/she will choose %s people for this mission. For leader, check your PM",
-			game.Round, game.VotingRound, leader.Name, game.Config.NOverview[game.Round-1]))
+	b.push(game.ID, b.templates.render("start_pick", data))
 }
 
-func (b *LineBot) OnPick(game *Game, leader *Player, picked *Player, err error) {
+func (b *LineBot) OnPick(game *Snapshot, leader *Player, picked *Player, err error) {
 	if err != nil {
 		b.push(game.ID, err.Error())
 		return
 	}
 
-	var buffer bytes.Buffer
-	var bufferPM bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("%s chooses %s.\n\nCurrent team (need %s people):", leader.Name, picked.Name, game.Config.NOverview[game.Round-1]))
-	bufferPM.WriteString(fmt.Sprintf("You choose %s.\n\nCurrent team (need %s people):", picked.Name, game.Config.NOverview[game.Round-1]))
-	i := 1
-	for _, player := range game.Picks {
-		buffer.WriteString(fmt.Sprintf("\n%d. %s", i, player.Name))
-		bufferPM.WriteString(fmt.Sprintf("\n%d. %s", i, player.Name))
-		i++
+	data := pickMessage{
+		Round:       game.Round,
+		VotingRound: game.VotingRound,
+		Leader:      leader.Name,
+		Player:      picked.Name,
+		Required:    game.Config.NOverview[game.Round-1],
+		Team:        playerNames(game.GetPicks()),
 	}
-	b.push(game.ID, buffer.String())
-	b.push(leader.ID, bufferPM.String())
+	b.push(game.ID, b.templates.render("pick", data))
+	b.push(leader.ID, b.templates.render("pick_pm", data))
 }
 
-func (b *LineBot) OnUnpick(game *Game, leader *Player, unpicked *Player, err error) {
+func (b *LineBot) OnUnpick(game *Snapshot, leader *Player, unpicked *Player, err error) {
 	if err != nil {
 		b.push(game.ID, err.Error())
 		return
 	}
 
-	var buffer bytes.Buffer
-	var bufferPM bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("%s cancels %s.\n\nCurrent team (need %s people):", leader.Name, unpicked.Name, game.Config.NOverview[game.Round-1]))
-	bufferPM.WriteString(fmt.Sprintf("You cancel %s.\n\nCurrent team (need %s people):", unpicked.Name, game.Config.NOverview[game.Round-1]))
-	i := 1
-	for _, player := range game.Picks {
-		buffer.WriteString(fmt.Sprintf("\n%d. %s", i, player.Name))
-		bufferPM.WriteString(fmt.Sprintf("\n%d. %s", i, player.Name))
-		i++
+	data := pickMessage{
+		Round:       game.Round,
+		VotingRound: game.VotingRound,
+		Leader:      leader.Name,
+		Player:      unpicked.Name,
+		Required:    game.Config.NOverview[game.Round-1],
+		Team:        playerNames(game.GetPicks()),
 	}
-	if len(game.Picks) == 0 {
-		buffer.WriteString(fmt.Sprintf("\n(no members yet)"))
-		bufferPM.WriteString(fmt.Sprintf("\n(no members yet)"))
-	}
-	b.push(game.ID, buffer.String())
-	b.push(leader.ID, bufferPM.String())
+	b.push(game.ID, b.templates.render("unpick", data))
+	b.push(leader.ID, b.templates.render("unpick_pm", data))
 }
 
-func (b *LineBot) OnDonePick(game *Game, leader *Player, err error) {
+func (b *LineBot) OnDonePick(game *Snapshot, leader *Player, err error) {
 	if err != nil {
 		b.push(game.ID, err.Error())
 		return
 	}
 }
 
-func (b *LineBot) OnStartVoting(game *Game, leader *Player, members []*Player) {
-	var buffer bytes.Buffer
-	var bufferPM bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("[Vote on team]\n[Mission #%d, Leader #%d]\n\n%s has chosen the following people:", game.Round, game.VotingRound, leader.Name))
-	bufferPM.WriteString(fmt.Sprintf("[Vote on team]\n[Mission #%d, Leader #%d]\n\n%s has chosen the following people:", game.Round, game.VotingRound, leader.Name))
+func (b *LineBot) OnStartVoting(game *Snapshot, leader *Player, members []*Player) {
+	data := votingMessage{
+		Round:       game.Round,
+		VotingRound: game.VotingRound,
+		Leader:      leader.Name,
+		Seconds:     conf.GameVotingTime,
+	}
 	for i, player := range members {
-		if leader.ID == player.ID {
-			buffer.WriteString(fmt.Sprintf("\n%d. %s (leader)", i+1, player.Name))
-			bufferPM.WriteString(fmt.Sprintf("\n%d. %s (leader)", i+1, player.Name))
-		} else {
-			buffer.WriteString(fmt.Sprintf("\n%d. %s", i+1, player.Name))
-			bufferPM.WriteString(fmt.Sprintf("\n%d. %s", i+1, player.Name))
-		}
+		data.Members = append(data.Members, playerView{
+			Number: i + 1,
+			Name:   player.Name,
+			Leader: leader.ID == player.ID,
+		})
 	}
-	buffer.WriteString(fmt.Sprintf("\n\nFor all, check your PM. You have %d seconds to approve/reject the choice. If you don't vote, it will count as a Reject.", conf.GameVotingTime))
-	bufferPM.WriteString(fmt.Sprintf("\n\nYou have %d seconds to approve/reject the choice. If you don't vote, it will count as a Reject.", conf.GameVotingTime))
-	b.push(game.ID, buffer.String())
+	b.push(game.ID, b.templates.render("start_voting", data))
 
+	messagePM := b.templates.render("start_voting_pm", data)
 	for _, player := range game.Players {
-		b.push(player.ID, bufferPM.String())
+		b.push(player.ID, messagePM)
 		b.pushPostback(player.ID,
 			fmt.Sprintf("Mission #%d, Leader #%d", game.Round, game.VotingRound),
 			"Vote here",
-			pair{"Approve", ".vote:" + game.ID + ":approve"},
-			pair{"Reject", ".vote:" + game.ID + ":reject"},
+			pair{"Approve", signPostback(game, ".vote:"+game.ID+":approve")},
+			pair{"Reject", signPostback(game, ".vote:"+game.ID+":reject")},
 		)
 	}
 }
 
-func (b *LineBot) OnVote(game *Game, player *Player, ok bool, err error) {
+func (b *LineBot) OnVote(game *Snapshot, player *Player, ok bool, err error) {
 	if err != nil {
 		b.push(player.ID, err.Error())
 		return
 	}
 
-	var vote string
-	if ok {
-		vote = "Approve"
-	} else {
-		vote = "Reject"
-	}
-	b.push(player.ID, fmt.Sprintf("You vote %s. You can always change this before the time runs out", vote))
+	b.push(player.ID, b.templates.render("vote", voteMessage{ok}))
 }
 
-func (b *LineBot) OnVotingDone(game *Game, votes map[string]bool, majority bool) {
-	var buffer bytes.Buffer
-	buffer.WriteString("Here are the voting result:")
-	for voter, vote := range votes {
-		if vote {
-			buffer.WriteString(fmt.Sprintf("\n- %s voted Approve", voter))
-		} else {
-			buffer.WriteString(fmt.Sprintf("\n- %s voted Reject", voter))
-		}
+func (b *LineBot) OnVotingDone(game *Snapshot, votes map[string]bool, majority bool) {
+	data := votingDoneMessage{
+		Majority:  majority,
+		LastRound: game.VotingRound == conf.GameVotingRound,
 	}
-	if len(votes) == 0 {
-		buffer.WriteString("\n(no one votes)")
-	} else if len(votes) < game.NPlayers {
-		buffer.WriteString(fmt.Sprintf("\n(The rest %d people did not vote)", game.NPlayers-len(votes)))
+	for voter, vote := range votes {
+		data.Votes = append(data.Votes, voteView{voter, vote})
 	}
-	if majority {
-		buffer.WriteString("\n\nMajority is reached. Mission will be executed.")
-	} else {
-		if game.VotingRound == conf.GameVotingRound {
-			buffer.WriteString("\n\nMajority is not reached.")
-		} else {
-			buffer.WriteString("\n\nMajority is not reached. Moving on to the next leader.")
-		}
+	if len(votes) < game.NPlayers {
+		data.NotVoted = game.NPlayers - len(votes)
 	}
-	b.push(game.ID, buffer.String())
+	b.push(game.ID, b.templates.render("voting_done", data))
 }
 
-func (b *LineBot) OnStartMission(game *Game, members []*Player) {
-	var buffer bytes.Buffer
-	var bufferPM bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("[Executing Mission #%d]", game.Round))
-	bufferPM.WriteString(fmt.Sprintf("[Executing Mission #%d]", game.Round))
-	buffer.WriteString("\n\nMembers:")
-	bufferPM.WriteString("\n\nMembers:")
-	for i, member := range members {
-		buffer.WriteString(fmt.Sprintf("\n%d. %s", i+1, member.Name))
-		bufferPM.WriteString(fmt.Sprintf("\n%d. %s", i+1, member.Name))
-	}
-	buffer.WriteString(fmt.Sprintf("\n\nFor all members, check your PM to execute this mission. If you do not choose, it will be considered as a Success. You have %d seconds.", conf.GameMissionTime))
-	bufferPM.WriteString(fmt.Sprintf("\n\nChoose between success/fail. If you do not choose, it will be considered as a Success. You have %d seconds.", conf.GameMissionTime))
-	b.push(game.ID, buffer.String())
+func (b *LineBot) OnStartMission(game *Snapshot, members []*Player) {
+	data := missionMessage{
+		Round:   game.Round,
+		Members: playerNames(members),
+		Seconds: conf.GameMissionTime,
+	}
+	b.push(game.ID, b.templates.render("start_mission", data))
 
+	messagePM := b.templates.render("start_mission_pm", data)
 	for _, member := range members {
-		b.push(member.ID, bufferPM.String())
+		b.push(member.ID, messagePM)
 		b.pushPostback(member.ID,
 			fmt.Sprintf("Mission #%d", game.Round),
 			"Choose the outcome of this mission",
-			pair{"Success", ".executemission:" + game.ID + ":success"},
-			pair{"Fail", ".executemission:" + game.ID + ":fail"},
+			pair{"Success", signPostback(game, ".executemission:"+game.ID+":success")},
+			pair{"Fail", signPostback(game, ".executemission:"+game.ID+":fail")},
 		)
 	}
 }
 
-func (b *LineBot) OnExecuteMission(game *Game, player *Player, success bool) {
-	if player.Role == ROLE_RESISTANCE {
-		if success {
-			b.push(player.ID, "You choose Success")
-		} else {
-			b.push(player.ID, "You cannot fail this mission as you are a Resistance")
-		}
-	} else {
-		if success {
-			b.push(player.ID, "You choose Success")
-		} else {
-			b.push(player.ID, "You choose Fail")
-		}
-	}
+func (b *LineBot) OnExecuteMission(game *Snapshot, player *Player, success bool) {
+	b.push(player.ID, b.templates.render("execute_mission", executeMissionMessage{
+		Success:    success,
+		Resistance: player.Role == ROLE_RESISTANCE,
+	}))
 }
 
-func (b *LineBot) OnMissionDone(game *Game, mission *Mission) {
-	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("[Executing Mission #%d]", game.Round))
-	buffer.WriteString("\n\nMembers:")
-	for i, member := range mission.Members {
-		buffer.WriteString(fmt.Sprintf("\n%d. %s", i+1, member.Name))
-	}
-	if mission.Success {
-		buffer.WriteString("\n\nOutcome: Success")
-	} else {
-		buffer.WriteString("\n\nOutcome: Fail")
-	}
-	buffer.WriteString(fmt.Sprintf(" (%d success, %d fail)", mission.NSuccess(), mission.NFail()))
-	b.push(game.ID, buffer.String())
+func (b *LineBot) OnMissionDone(game *Snapshot, mission *Mission) {
+	b.push(game.ID, b.templates.render("mission_done", missionMessage{
+		Round:    game.Round,
+		Members:  playerNames(mission.Members),
+		Success:  mission.Success,
+		NSuccess: mission.NSuccess(),
+		NFail:    mission.NFail(),
+	}))
 }
 
-func (b *LineBot) OnSpyWin(game *Game, message string) {
-	b.push(game.ID, message)
+func (b *LineBot) OnSpyWin(game *Snapshot) {
+	b.push(game.ID, b.templates.render("spy_win", newGameOverMessage(game)))
 	b.OnShowPlayers(game, game.Players, -1, true)
+	b.report(game)
+	b.offerRematch(game)
 }
 
-func (b *LineBot) OnResistanceWin(game *Game, message string) {
-	b.push(game.ID, message)
+func (b *LineBot) OnResistanceWin(game *Snapshot) {
+	b.push(game.ID, b.templates.render("resistance_win", newGameOverMessage(game)))
 	b.OnShowPlayers(game, game.Players, -1, true)
+	b.report(game)
+	b.offerRematch(game)
 }
 
-func (b *LineBot) OnStartWarning(game *Game, seconds int) {
-	b.push(game.ID, fmt.Sprintf("Game will be started in %d seconds", seconds))
+func (b *LineBot) OnStartWarning(game *Snapshot, seconds int) {
+	b.push(game.ID, b.templates.render("start_warning", secondsMessage{seconds}))
 }
 
-func (b *LineBot) OnVotingWarning(game *Game, seconds int) {
+func (b *LineBot) OnVotingWarning(game *Snapshot, seconds int) {
 	for _, player := range game.Picks {
-		b.push(player.ID, fmt.Sprintf("You have %d seconds left", seconds))
+		b.push(player.ID, b.templates.render("time_warning", secondsMessage{seconds}))
 	}
 }
 
-func (b *LineBot) OnMissionWarning(game *Game, seconds int) {
+func (b *LineBot) OnMissionWarning(game *Snapshot, seconds int) {
 	for _, player := range game.Picks {
-		b.push(player.ID, fmt.Sprintf("You have %d seconds left", seconds))
+		b.push(player.ID, b.templates.render("time_warning", secondsMessage{seconds}))
+	}
+}
+
+func (b *LineBot) OnSuspend(game *Snapshot) {
+	b.push(game.ID, b.templates.render("suspend", nil))
+}
+
+func (b *LineBot) OnResume(game *Snapshot) {
+	data := resumeMessage{
+		Round:       game.Round,
+		VotingRound: game.VotingRound,
+	}
+	if game.State != STATE_INITIALIZED {
+		data.Stage = game.State.String()
+	}
+	b.push(game.ID, b.templates.render("resume", data))
+}
+
+// ResumeGames restarts the games saved in store, see Resume.
+func (b *LineBot) ResumeGames(store Store) (int, error) {
+	return Resume(store, b.handlers)
+}
+
+func playerNames(players []*Player) []string {
+	var names []string
+	for _, player := range players {
+		names = append(names, player.Name)
 	}
+	return names
 }
@@ -0,0 +1,172 @@
+package resistance
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/azaky/resistancebot/util"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// testBot is a LineBot whose replies are recorded instead of sent.
+type testBot struct {
+	*LineBot
+
+	lock    sync.Mutex
+	replies []string
+}
+
+func newTestBot() *testBot {
+	b := &testBot{LineBot: NewLineBot(nil, nil)}
+	SetReachability(nil)
+	b.sendReply = func(replyToken string, messages ...linebot.Message) error {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for _, message := range messages {
+			switch m := message.(type) {
+			case *linebot.TextMessage:
+				b.replies = append(b.replies, m.Text)
+			case *linebot.TemplateMessage:
+				b.replies = append(b.replies, m.AltText)
+			}
+		}
+		return nil
+	}
+	return b
+}
+
+// postback sends the data of a button pressed by userID, and returns what
+// the bot replied.
+func (b *testBot) postback(userID, data string) []string {
+	b.lock.Lock()
+	b.replies = nil
+	b.lock.Unlock()
+	event := &linebot.Event{
+		ReplyToken: "token",
+		Type:       linebot.EventTypePostback,
+		Source:     &linebot.EventSource{Type: linebot.EventSourceTypeUser, UserID: userID},
+		Postback:   &linebot.Postback{Data: data},
+	}
+	b.handlePostback(ctx, event, event.Postback)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.replies
+}
+
+// private sends text to the bot in a private chat, and returns what the bot
+// replied.
+func (b *testBot) private(userID, text string) []string {
+	b.lock.Lock()
+	b.replies = nil
+	b.lock.Unlock()
+	event := &linebot.Event{
+		ReplyToken: "token",
+		Type:       linebot.EventTypeMessage,
+		Source:     &linebot.EventSource{Type: linebot.EventSourceTypeUser, UserID: userID},
+	}
+	b.handleTextMessage(ctx, event, &linebot.TextMessage{Text: text})
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.replies
+}
+
+func TestPrivateCommands(t *testing.T) {
+	b := newTestBot()
+	rec := newRecorder()
+	game := newTestGame(t, "test-private", 5, rec)
+	defer game.Abort(ctx, "system")
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	leader := <-rec.startPick
+	var member string
+	for i := 0; i < 5; i++ {
+		if playerID(i) != leader.ID {
+			member = playerID(i)
+			break
+		}
+	}
+
+	tests := []struct {
+		userID string
+		text   string
+		want   string
+	}{
+		{"stranger", ".vote yes", "You are not playing in any game"},
+		{"stranger", ".pick 1", "You are not playing in any game"},
+		{leader.ID, ".pick 0", "Choose a number between 1 and 5"},
+		{leader.ID, ".pick 6", "Choose a number between 1 and 5"},
+		{member, ".vote yes", rejections[cmdVote].Error()},
+		{member, ".mission fail", rejections[cmdExecuteMission].Error()},
+		{leader.ID, ".pick 1", ""},
+	}
+	for _, test := range tests {
+		replies := b.private(test.userID, test.text)
+		switch {
+		case test.want == "" && len(replies) > 0:
+			t.Errorf("%s from %s: replied %q, expected nothing", test.text, test.userID, replies)
+		case test.want != "" && (len(replies) != 1 || replies[0] != test.want):
+			t.Errorf("%s from %s: replied %q, expected %q", test.text, test.userID, replies, test.want)
+		}
+	}
+	if picks := game.Snapshot().GetPicks(); len(picks) != 1 || picks[0].ID != game.Snapshot().Players[0].ID {
+		t.Errorf("Picked %v, expected the first player", picks)
+	}
+}
+
+func TestSignedPostbacks(t *testing.T) {
+	b := newTestBot()
+	rec := newRecorder()
+	game := newTestGame(t, "test-signed", 5, rec)
+	defer game.Abort(ctx, "system")
+	if err := game.Start(ctx, playerID(0)); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	leader := <-rec.startPick
+	s := game.Snapshot()
+	pick := func(i int) string {
+		return ".pick:" + s.ID + ":" + s.Players[i].ID
+	}
+
+	stale := s.clone()
+	stale.Phase--
+	other := s.clone()
+	other.nonce = newNonce()
+	forged := signPostback(s, pick(0))
+	if strings.HasSuffix(forged, "0") {
+		forged = strings.TrimSuffix(forged, "0") + "1"
+	} else {
+		forged = forged[:len(forged)-1] + "0"
+	}
+	data := fmt.Sprintf("%s:%d", pick(0), s.Phase)
+	expired := []string{
+		forged,
+		// Signed with the webhook key instead
+		data + ":" + util.Sign(conf.LineChannelSecret, s.nonce, data),
+		signPostback(stale, pick(0)),
+		signPostback(other, pick(0)),
+		// Buttons from before they were signed
+		pick(0),
+		".donepick:" + s.ID,
+		".vote:" + s.ID + ":approve",
+		".executemission:" + s.ID + ":fail",
+	}
+	for _, data := range expired {
+		replies := b.postback(leader.ID, data)
+		if len(replies) != 1 || replies[0] != ErrExpired.Error() {
+			t.Errorf("%s: replied %q, expected %q", data, replies, ErrExpired.Error())
+		}
+	}
+	if picks := game.Snapshot().GetPicks(); len(picks) != 0 {
+		t.Fatalf("Expired buttons picked %v", picks)
+	}
+
+	if replies := b.postback(leader.ID, signPostback(s, pick(0))); len(replies) != 0 {
+		t.Errorf("Signed button replied %q", replies)
+	}
+	if picks := game.Snapshot().GetPicks(); len(picks) != 1 || picks[0].ID != s.Players[0].ID {
+		t.Errorf("Signed button picked %v, expected the first player", picks)
+	}
+}
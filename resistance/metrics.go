@@ -0,0 +1,136 @@
+package resistance
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are registered with the default Prometheus registry, and served
+// by promhttp.Handler().
+
+var (
+	gamesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "resistance_games_created_total",
+		Help: "Games created.",
+	})
+	gamesStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "resistance_games_started_total",
+		Help: "Games started.",
+	})
+	gamesFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "resistance_games_finished_total",
+		Help: "Games played to the end, by winning side.",
+	}, []string{"winner"})
+	gamesAborted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "resistance_games_aborted_total",
+		Help: "Games aborted, by players, admins or the start timer.",
+	})
+	daemons = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "resistance_game_daemons",
+		Help: "Game daemon goroutines running.",
+	})
+	webhookEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "resistance_webhook_events_total",
+		Help: "LINE webhook events received, by type.",
+	}, []string{"type"})
+	lineAPIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "resistance_line_api_duration_seconds",
+		Help:    "Latency of LINE API calls, by method.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method"})
+	lineAPIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "resistance_line_api_errors_total",
+		Help: "Failed LINE API calls, by method and HTTP status (\"error\" if there was no answer).",
+	}, []string{"method", "code"})
+)
+
+var activeGamesDesc = prometheus.NewDesc(
+	"resistance_active_games",
+	"Games currently running, by state.",
+	[]string{"state"}, nil,
+)
+
+// activeGames counts the registered games by state whenever it is scraped.
+type activeGames struct{}
+
+func (activeGames) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeGamesDesc
+}
+
+func (activeGames) Collect(ch chan<- prometheus.Metric) {
+	count := map[State]int{
+		STATE_INITIALIZED: 0,
+		STATE_PICK:        0,
+		STATE_VOTING:      0,
+		STATE_MISSION:     0,
+	}
+	for _, game := range ListGames() {
+		count[game.Snapshot().State]++
+	}
+	for state, n := range count {
+		ch <- prometheus.MustNewConstMetric(activeGamesDesc, prometheus.GaugeValue, float64(n), state.String())
+	}
+}
+
+func init() {
+	prometheus.MustRegister(
+		gamesCreated,
+		gamesStarted,
+		gamesFinished,
+		gamesAborted,
+		daemons,
+		webhookEvents,
+		lineAPIDuration,
+		lineAPIErrors,
+		activeGames{},
+	)
+}
+
+// observeLineCall records the latency and outcome of a LINE API call
+// started at start.
+func observeLineCall(method string, start time.Time, err error) {
+	lineAPIDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+	code := "error"
+	if apiErr, ok := err.(*linebot.APIError); ok {
+		code = strconv.Itoa(apiErr.Code)
+	}
+	lineAPIErrors.WithLabelValues(method, code).Inc()
+}
+
+// Metrics counts game outcomes. Subscribe it to the games whose outcomes
+// should be counted, see LineBot.Subscribe.
+type Metrics struct {
+	BaseEventHandler
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) OnCreate(game *Snapshot) {
+	gamesCreated.Inc()
+}
+
+func (m *Metrics) OnStart(game *Snapshot, starter *Player, c *Config, err error) {
+	if err == nil {
+		gamesStarted.Inc()
+	}
+}
+
+func (m *Metrics) OnAbort(game *Snapshot, aborter *Player) {
+	gamesAborted.Inc()
+}
+
+func (m *Metrics) OnSpyWin(game *Snapshot) {
+	gamesFinished.WithLabelValues("spy").Inc()
+}
+
+func (m *Metrics) OnResistanceWin(game *Snapshot) {
+	gamesFinished.WithLabelValues("resistance").Inc()
+}
@@ -0,0 +1,94 @@
+package resistance
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	cache "github.com/patrickmn/go-cache"
+)
+
+var stageNames = map[State]string{
+	STATE_INITIALIZED: "waiting for players",
+	STATE_PICK:        "leader chooses team",
+	STATE_VOTING:      "voting on team",
+	STATE_MISSION:     "executing mission",
+}
+
+// describeGames lists games for .mygame, marking the one private commands
+// go to.
+func describeGames(list []*Game, current *Game) string {
+	var buffer bytes.Buffer
+	for i, game := range list {
+		s := game.Snapshot()
+		if i > 0 {
+			buffer.WriteString("\n")
+		}
+		buffer.WriteString(fmt.Sprintf("%d. ", i+1))
+		if s.Round > 0 {
+			buffer.WriteString(fmt.Sprintf("Mission #%d, ", s.Round))
+		}
+		buffer.WriteString(fmt.Sprintf("%s. Players: %s", stageNames[s.State], strings.Join(playerNames(s.Players), ", ")))
+		if game == current && len(list) > 1 {
+			buffer.WriteString(" (current)")
+		}
+	}
+	return buffer.String()
+}
+
+// currentGame returns the game private commands from userID go to: their
+// only game, or the one they chose with .mygame. It returns nil, and the
+// games to choose from, if they haven't chosen yet.
+func (b *LineBot) currentGame(userID string) (*Game, []*Game) {
+	list := GamesByPlayer(userID)
+	if len(list) == 1 {
+		return list[0], list
+	}
+	if id, ok := b.currentGames.Get(userID); ok {
+		for _, game := range list {
+			if game.ID == id.(string) {
+				return game, list
+			}
+		}
+	}
+	return nil, list
+}
+
+// playerGame is currentGame for a private command, telling the user what
+// to do when there is no game to send it to.
+func (b *LineBot) playerGame(event *linebot.Event) *Game {
+	game, list := b.currentGame(event.Source.UserID)
+	if game != nil {
+		return game
+	}
+	if len(list) == 0 {
+		b.reply(event, "You are not playing in any game")
+	} else {
+		b.reply(event, "You are playing in more than one game. Type \".mygame <number>\" to choose one first:\n\n"+describeGames(list, nil))
+	}
+	return nil
+}
+
+func (b *LineBot) myGame(ctx context.Context, event *linebot.Event, args ...string) {
+	userID := event.Source.UserID
+	current, list := b.currentGame(userID)
+	if len(list) == 0 {
+		b.reply(event, "You are not playing in any game")
+		return
+	}
+	if args[1] == "" {
+		b.reply(event, "Your games:\n\n"+describeGames(list, current))
+		return
+	}
+
+	number, _ := strconv.Atoi(args[1])
+	if number < 1 || number > len(list) {
+		b.reply(event, fmt.Sprintf("Choose a number between 1 and %d", len(list)))
+		return
+	}
+	b.currentGames.Set(userID, list[number-1].ID, cache.DefaultExpiration)
+	b.reply(event, fmt.Sprintf("Your commands here now go to game #%d", number))
+}
@@ -0,0 +1,367 @@
+package resistance
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// RECORD_VERSION is the version of the notation written by Export.
+const RECORD_VERSION = 1
+
+// Record is a complete game in a portable JSON notation, for sharing games
+// with analysis tools. Players are referred to by seat, their index in
+// Players, since LINE user IDs are private. Roles are included, so only
+// export games that are over.
+type Record struct {
+	Version int            `json:"version"`
+	ID      string         `json:"id,omitempty"`
+	Config  RecordConfig   `json:"config"`
+	Players []RecordPlayer `json:"players"`
+	// Proposals are all teams voted on, in order
+	Proposals []RecordProposal `json:"proposals"`
+	// Missions are the missions played, in order
+	Missions []RecordMission `json:"missions"`
+	// Winner is "spy" or "resistance", or empty if the game is not over
+	Winner string `json:"winner,omitempty"`
+}
+
+type RecordConfig struct {
+	NPlayers int   `json:"n_players"`
+	NSpies   int   `json:"n_spies"`
+	NMembers []int `json:"n_members"`
+	NFail    []int `json:"n_fail"`
+	// VotingRounds is the number of rejected teams in a round that makes
+	// the spies win
+	VotingRounds int `json:"voting_rounds"`
+}
+
+type RecordPlayer struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type RecordProposal struct {
+	Round       int   `json:"round"`
+	VotingRound int   `json:"voting_round"`
+	Leader      int   `json:"leader"`
+	Team        []int `json:"team"`
+	// Votes has a vote for each seat: "approve", "reject", or "" for
+	// players who did not vote
+	Votes    []string `json:"votes"`
+	Approved bool     `json:"approved"`
+}
+
+type RecordMission struct {
+	Round int   `json:"round"`
+	Team  []int `json:"team"`
+	// Cards has a card for each member of Team: "success" or "fail"
+	Cards   []string `json:"cards"`
+	Success bool     `json:"success"`
+}
+
+var roleNames = map[Role]string{
+	ROLE_RESISTANCE: "resistance",
+	ROLE_SPY:        "spy",
+}
+
+// Export writes down game in the notation. A mission that is still running
+// is left out.
+func Export(game *Snapshot) (*Record, error) {
+	if game.Config == nil {
+		return nil, fmt.Errorf("Game %s has not started", game.ID)
+	}
+	c := game.Config
+	r := &Record{
+		Version: RECORD_VERSION,
+		ID:      game.ID,
+		Config: RecordConfig{
+			NPlayers:     c.NPlayers,
+			NSpies:       c.NSpies,
+			NMembers:     c.NMembers,
+			NFail:        c.NFail,
+			VotingRounds: conf.GameVotingRound,
+		},
+		Players:   []RecordPlayer{},
+		Proposals: []RecordProposal{},
+		Missions:  []RecordMission{},
+	}
+	seats := make(map[string]int)
+	for i, player := range game.Players {
+		seats[player.ID] = i
+		r.Players = append(r.Players, RecordPlayer{Name: player.Name, Role: roleNames[player.Role]})
+	}
+	seatsOf := func(players []*Player) []int {
+		list := []int{}
+		for _, player := range players {
+			list = append(list, seats[player.ID])
+		}
+		return list
+	}
+
+	for _, p := range game.Proposals {
+		proposal := RecordProposal{
+			Round:       p.Round,
+			VotingRound: p.VotingRound,
+			Leader:      seats[p.Leader.ID],
+			Team:        seatsOf(p.Team),
+			Votes:       make([]string, len(game.Players)),
+			Approved:    p.Approved,
+		}
+		for id, vote := range p.Votes {
+			proposal.Votes[seats[id]] = voteName(vote)
+		}
+		r.Proposals = append(r.Proposals, proposal)
+	}
+	for _, m := range game.Missions {
+		if m == game.CurrentMission() {
+			break
+		}
+		mission := RecordMission{
+			Round:   m.Round,
+			Team:    seatsOf(m.Members),
+			Success: m.Success,
+		}
+		for _, member := range m.Members {
+			mission.Cards = append(mission.Cards, cardName(m.Votes[member.ID]))
+		}
+		r.Missions = append(r.Missions, mission)
+	}
+
+	if game.SpyWin() {
+		r.Winner = roleNames[ROLE_SPY]
+	} else if game.ResistanceWin() {
+		r.Winner = roleNames[ROLE_RESISTANCE]
+	}
+	return r, nil
+}
+
+func voteName(approve bool) string {
+	if approve {
+		return "approve"
+	}
+	return "reject"
+}
+
+func cardName(success bool) string {
+	if success {
+		return "success"
+	}
+	return "fail"
+}
+
+// Import reads a game in the notation and replays it, see Replay.
+func Import(data []byte) (*Snapshot, error) {
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("Invalid record: %s", err.Error())
+	}
+	return Replay(&r)
+}
+
+// Replay plays the game in r again by the rules of the engine, and returns
+// the game as it ended. It fails if r breaks any rule: a leader out of
+// turn, a team of the wrong size, a result that doesn't match the votes
+// or the cards, etc.
+func Replay(r *Record) (*Snapshot, error) {
+	if r.Version != RECORD_VERSION {
+		return nil, fmt.Errorf("Unsupported record version %d", r.Version)
+	}
+	c, ok := gameConfigMap[len(r.Players)]
+	if !ok {
+		return nil, fmt.Errorf("No config for %d players", len(r.Players))
+	}
+	if r.Config.NPlayers != c.NPlayers || r.Config.NSpies != c.NSpies ||
+		!reflect.DeepEqual(r.Config.NMembers, c.NMembers) || !reflect.DeepEqual(r.Config.NFail, c.NFail) {
+		return nil, fmt.Errorf("Config does not match the rules for %d players", c.NPlayers)
+	}
+	if r.Config.VotingRounds < 1 {
+		return nil, fmt.Errorf("Invalid number of voting rounds %d", r.Config.VotingRounds)
+	}
+
+	s := &Snapshot{
+		ID:          r.ID,
+		Players:     []*Player{},
+		NPlayers:    len(r.Players),
+		State:       STATE_PICK,
+		Round:       1,
+		LeaderIndex: -1,
+		Missions:    []*Mission{},
+		Proposals:   []*Proposal{},
+		Config:      c,
+	}
+	nspies := 0
+	for i, player := range r.Players {
+		p := &Player{ID: fmt.Sprintf("seat%d", i), Name: player.Name}
+		switch player.Role {
+		case roleNames[ROLE_SPY]:
+			p.Role = ROLE_SPY
+			nspies++
+		case roleNames[ROLE_RESISTANCE]:
+			p.Role = ROLE_RESISTANCE
+		default:
+			return nil, fmt.Errorf("Unknown role %q of %s", player.Role, player.Name)
+		}
+		s.Players = append(s.Players, p)
+	}
+	if nspies != c.NSpies {
+		return nil, fmt.Errorf("%d spies, expected %d", nspies, c.NSpies)
+	}
+	seat := func(i int) (*Player, error) {
+		if i < 0 || i >= len(s.Players) {
+			return nil, fmt.Errorf("No player at seat %d", i)
+		}
+		return s.Players[i], nil
+	}
+	team := func(seats []int) ([]*Player, error) {
+		var players []*Player
+		picked := make(map[int]bool)
+		for _, i := range seats {
+			player, err := seat(i)
+			if err != nil {
+				return nil, err
+			}
+			if picked[i] {
+				return nil, fmt.Errorf("%s is in the team twice", player.Name)
+			}
+			picked[i] = true
+			players = append(players, player)
+		}
+		return players, nil
+	}
+
+	missions := r.Missions
+	// pending is the mission the record ends in the middle of, if any
+	var pending *Mission
+	for n, rp := range r.Proposals {
+		if s.Over() {
+			return nil, fmt.Errorf("Proposal #%d after the game is over", n+1)
+		}
+		s.VotingRound++
+		if rp.Round != s.Round || rp.VotingRound != s.VotingRound {
+			return nil, fmt.Errorf("Proposal #%d is in round %d.%d, expected %d.%d",
+				n+1, rp.Round, rp.VotingRound, s.Round, s.VotingRound)
+		}
+		if n > 0 && rp.Leader != (s.LeaderIndex+1)%s.NPlayers {
+			return nil, fmt.Errorf("Proposal #%d is led out of turn", n+1)
+		}
+		leader, err := seat(rp.Leader)
+		if err != nil {
+			return nil, err
+		}
+		s.LeaderIndex = rp.Leader
+		members, err := team(rp.Team)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) != c.NMembers[s.Round-1] {
+			return nil, fmt.Errorf("Proposal #%d has %d members, expected %d", n+1, len(members), c.NMembers[s.Round-1])
+		}
+		if len(rp.Votes) != s.NPlayers {
+			return nil, fmt.Errorf("Proposal #%d has %d votes, expected one for each of %d players", n+1, len(rp.Votes), s.NPlayers)
+		}
+		votes := make(map[string]bool)
+		for i, vote := range rp.Votes {
+			switch vote {
+			case "approve", "reject":
+				votes[s.Players[i].ID] = vote == "approve"
+			case "":
+			default:
+				return nil, fmt.Errorf("Unknown vote %q in proposal #%d", vote, n+1)
+			}
+		}
+		if majority(votes, s.NPlayers) != rp.Approved {
+			return nil, fmt.Errorf("Proposal #%d does not have the result of its votes", n+1)
+		}
+		s.Proposals = append(s.Proposals, &Proposal{
+			Round:       s.Round,
+			VotingRound: s.VotingRound,
+			Leader:      leader,
+			Team:        members,
+			Votes:       votes,
+			Approved:    rp.Approved,
+		})
+
+		if !rp.Approved {
+			if s.VotingRound == r.Config.VotingRounds {
+				s.spyWonByRejection = true
+			}
+			continue
+		}
+
+		if len(missions) == 0 {
+			// The record ends in the middle of the mission
+			if n != len(r.Proposals)-1 {
+				return nil, fmt.Errorf("Mission #%d is missing", s.Round)
+			}
+			pending = newReplayMission(s, members)
+			break
+		}
+		rm := missions[0]
+		missions = missions[1:]
+		if rm.Round != s.Round || !reflect.DeepEqual(rm.Team, rp.Team) {
+			return nil, fmt.Errorf("Mission #%d is not played by the approved team", rm.Round)
+		}
+		if len(rm.Cards) != len(members) {
+			return nil, fmt.Errorf("Mission #%d has %d cards, expected %d", rm.Round, len(rm.Cards), len(members))
+		}
+		mission := newReplayMission(s, members)
+		for i, card := range rm.Cards {
+			switch card {
+			case "success":
+			case "fail":
+				if members[i].Role != ROLE_SPY {
+					return nil, fmt.Errorf("%s cannot fail mission #%d as a resistance", members[i].Name, rm.Round)
+				}
+				mission.Votes[members[i].ID] = false
+			default:
+				return nil, fmt.Errorf("Unknown card %q in mission #%d", card, rm.Round)
+			}
+		}
+		if mission.Execute() != rm.Success {
+			return nil, fmt.Errorf("Mission #%d does not have the result of its cards", rm.Round)
+		}
+		s.Missions = append(s.Missions, mission)
+		if !s.Over() {
+			s.Round++
+			s.VotingRound = 0
+		}
+	}
+	if len(missions) > 0 {
+		return nil, fmt.Errorf("Mission #%d has no approved team", missions[0].Round)
+	}
+
+	// A pending mission has no result yet, it doesn't count for the winner
+	winner := ""
+	if s.SpyWin() {
+		winner = roleNames[ROLE_SPY]
+	} else if s.ResistanceWin() {
+		winner = roleNames[ROLE_RESISTANCE]
+	}
+	if winner != r.Winner {
+		return nil, fmt.Errorf("Record says %q won, but the replay says %q", r.Winner, winner)
+	}
+	if winner != "" {
+		s.State = STATE_IDLE
+	}
+	if pending != nil {
+		s.State = STATE_MISSION
+		s.Missions = append(s.Missions, pending)
+	}
+	return s, nil
+}
+
+// newReplayMission starts the mission of the current round, every card a
+// Success until played otherwise.
+func newReplayMission(s *Snapshot, members []*Player) *Mission {
+	mission := &Mission{
+		Round:   s.Round,
+		Members: members,
+		Votes:   make(map[string]bool),
+		MinFail: s.Config.NFail[s.Round-1],
+	}
+	for _, member := range members {
+		mission.Votes[member.ID] = true
+	}
+	return mission
+}
@@ -0,0 +1,76 @@
+package resistance
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A 5 player game the spies win 3 to 1, the second mission after a
+// rejected team.
+const sampleRecord = `{
+	"version": 1,
+	"id": "sample",
+	"config": {"n_players": 5, "n_spies": 2, "n_members": [2, 3, 2, 3, 3], "n_fail": [1, 1, 1, 1, 1], "voting_rounds": 5},
+	"players": [
+		{"name": "Alice", "role": "spy"},
+		{"name": "Bob", "role": "resistance"},
+		{"name": "Carol", "role": "resistance"},
+		{"name": "Dave", "role": "spy"},
+		{"name": "Eve", "role": "resistance"}
+	],
+	"proposals": [
+		{"round": 1, "voting_round": 1, "leader": 0, "team": [0, 1], "votes": ["approve", "approve", "approve", "approve", ""], "approved": true},
+		{"round": 2, "voting_round": 1, "leader": 1, "team": [1, 2, 3], "votes": ["reject", "reject", "approve", "approve", "reject"], "approved": false},
+		{"round": 2, "voting_round": 2, "leader": 2, "team": [1, 2, 4], "votes": ["reject", "approve", "approve", "reject", "approve"], "approved": true},
+		{"round": 3, "voting_round": 1, "leader": 3, "team": [2, 3], "votes": ["approve", "approve", "approve", "approve", "approve"], "approved": true},
+		{"round": 4, "voting_round": 1, "leader": 4, "team": [0, 1, 4], "votes": ["approve", "approve", "", "approve", "reject"], "approved": true}
+	],
+	"missions": [
+		{"round": 1, "team": [0, 1], "cards": ["fail", "success"], "success": false},
+		{"round": 2, "team": [1, 2, 4], "cards": ["success", "success", "success"], "success": true},
+		{"round": 3, "team": [2, 3], "cards": ["success", "fail"], "success": false},
+		{"round": 4, "team": [0, 1, 4], "cards": ["fail", "success", "success"], "success": false}
+	],
+	"winner": "spy"
+}`
+
+func TestRecordRoundTrip(t *testing.T) {
+	s, err := Import([]byte(sampleRecord))
+	if err != nil {
+		t.Fatalf("Import: %s", err)
+	}
+	if s.State != STATE_IDLE || !s.SpyWin() || len(s.Proposals) != 5 || len(s.Missions) != 4 {
+		t.Errorf("replay ended in %s with %d proposals, %d missions", s.State, len(s.Proposals), len(s.Missions))
+	}
+
+	r, err := Export(s)
+	if err != nil {
+		t.Fatalf("Export: %s", err)
+	}
+	var expected Record
+	json.Unmarshal([]byte(sampleRecord), &expected)
+	if !reflect.DeepEqual(r, &expected) {
+		exported, _ := json.Marshal(r)
+		t.Errorf("round trip changed the record:\n%s", exported)
+	}
+}
+
+func TestReplayRejectsInvalidRecords(t *testing.T) {
+	tests := []struct {
+		old, new, err string
+	}{
+		{`"leader": 2`, `"leader": 3`, "out of turn"},
+		{`"team": [2, 3], "votes"`, `"team": [2, 3, 4], "votes"`, "members"},
+		{`"cards": ["success", "fail"]`, `"cards": ["fail", "fail"]`, "as a resistance"},
+		{`"approved": false`, `"approved": true`, "result of its votes"},
+		{`"winner": "spy"`, `"winner": "resistance"`, "won"},
+	}
+	for _, test := range tests {
+		_, err := Import([]byte(strings.Replace(sampleRecord, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("replacing %s with %s returned %v", test.old, test.new, err)
+		}
+	}
+}
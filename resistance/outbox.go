@@ -0,0 +1,217 @@
+package resistance
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/azaky/resistancebot/logging"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// outboxBatchSize is the most messages LINE takes in a single push request.
+const outboxBatchSize = 5
+
+type pushFunc func(to string, messages ...linebot.Message) error
+
+// Outbox delivers push messages in the background. Every recipient has its
+// own queue, so messages arrive in the order they were pushed, and a
+// recipient being throttled doesn't hold back the others. Requests failing
+// with 429, 5xx or a network error are retried with exponential backoff and
+// jitter, or after as long as LINE asks, see RetryAfterTransport; other
+// failures are permanent and reported to failed.
+type Outbox struct {
+	push   pushFunc
+	failed func(to string, err error)
+
+	retries int
+	backoff time.Duration
+
+	lock *sync.Mutex
+	// queues holds the pending messages per recipient. A recipient has an
+	// entry as long as a goroutine is delivering to it.
+	queues map[string][]linebot.Message
+}
+
+func NewOutbox(push pushFunc, failed func(to string, err error)) *Outbox {
+	return &Outbox{
+		push:    push,
+		failed:  failed,
+		retries: 5,
+		backoff: time.Second,
+		lock:    &sync.Mutex{},
+		queues:  make(map[string][]linebot.Message),
+	}
+}
+
+// Push queues messages for to and returns right away.
+func (o *Outbox) Push(to string, messages ...linebot.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	pending, running := o.queues[to]
+	o.queues[to] = append(pending, messages...)
+	if !running {
+		go o.deliver(to)
+	}
+}
+
+// Pending returns the number of messages waiting to be delivered.
+func (o *Outbox) Pending() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	n := 0
+	for _, pending := range o.queues {
+		n += len(pending)
+	}
+	return n
+}
+
+// Flush waits until every queued message is delivered or given up on, or
+// ctx is done.
+func (o *Outbox) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		o.lock.Lock()
+		empty := len(o.queues) == 0
+		o.lock.Unlock()
+		if empty {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (o *Outbox) deliver(to string) {
+	for {
+		o.lock.Lock()
+		pending := o.queues[to]
+		if len(pending) == 0 {
+			delete(o.queues, to)
+			o.lock.Unlock()
+			return
+		}
+		n := len(pending)
+		if n > outboxBatchSize {
+			n = outboxBatchSize
+		}
+		batch := make([]linebot.Message, n)
+		copy(batch, pending)
+		o.queues[to] = pending[n:]
+		o.lock.Unlock()
+
+		if err := o.send(to, batch); err != nil && o.failed != nil {
+			o.failed(to, err)
+		}
+	}
+}
+
+func (o *Outbox) send(to string, batch []linebot.Message) error {
+	backoff := o.backoff
+	for attempt := 0; ; attempt++ {
+		err := o.push(to, batch...)
+		if err == nil || !retryable(err) || attempt == o.retries {
+			return err
+		}
+		wait, ok := retryAfter(err)
+		if !ok {
+			wait = jitter(backoff)
+		}
+		logging.WithFields(logging.Fields{"component": "outbox", "to": to}).Warnf("Retrying push in %s: %s", wait, err.Error())
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// jitter spreads retries between half and one and a half times backoff, so
+// that recipients throttled together don't retry together.
+func jitter(backoff time.Duration) time.Duration {
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)+1))
+}
+
+// retryable tells whether a failed push may succeed later.
+func retryable(err error) bool {
+	if apiErr, ok := err.(*linebot.APIError); ok {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	// Not an answer from LINE, e.g. a network error
+	return true
+}
+
+// RetryAfterError is returned by RetryAfterTransport when LINE answers 429
+// and says when to try again.
+type RetryAfterError struct {
+	After time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("Too many requests, retry after %s", e.After)
+}
+
+// retryAfter returns how long LINE asked to wait before retrying err.
+func retryAfter(err error) (time.Duration, bool) {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if e, ok := err.(*RetryAfterError); ok {
+		return e.After, true
+	}
+	return 0, false
+}
+
+// RetryAfterTransport turns 429 answers carrying Retry-After into
+// RetryAfterError. The LINE client only keeps the status code of failed
+// requests, so the header would be lost otherwise. Base defaults to
+// http.DefaultTransport.
+type RetryAfterTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *RetryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusTooManyRequests {
+		return res, err
+	}
+	after, ok := parseRetryAfter(res.Header.Get("Retry-After"))
+	if !ok {
+		return res, nil
+	}
+	res.Body.Close()
+	return nil, &RetryAfterError{After: after}
+}
+
+// parseRetryAfter reads a Retry-After header, given either in seconds or as
+// a date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		after := time.Until(date)
+		if after < 0 {
+			after = 0
+		}
+		return after, true
+	}
+	return 0, false
+}
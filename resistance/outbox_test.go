@@ -0,0 +1,130 @@
+package resistance
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// fakeLine records pushes, and fails the first ones with the queued errors.
+type fakeLine struct {
+	lock    sync.Mutex
+	errors  map[string][]error
+	batches map[string][][]string
+}
+
+func newFakeLine() *fakeLine {
+	return &fakeLine{
+		errors:  make(map[string][]error),
+		batches: make(map[string][][]string),
+	}
+}
+
+func (f *fakeLine) push(to string, messages ...linebot.Message) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if errs := f.errors[to]; len(errs) > 0 {
+		f.errors[to] = errs[1:]
+		return errs[0]
+	}
+	var texts []string
+	for _, message := range messages {
+		texts = append(texts, message.(*linebot.TextMessage).Text)
+	}
+	f.batches[to] = append(f.batches[to], texts)
+	return nil
+}
+
+func texts(prefix string, n int) []linebot.Message {
+	var messages []linebot.Message
+	for i := 0; i < n; i++ {
+		messages = append(messages, linebot.NewTextMessage(prefix+string(rune('a'+i))))
+	}
+	return messages
+}
+
+func TestOutboxOrderingAndBatching(t *testing.T) {
+	line := newFakeLine()
+	line.errors["alice"] = []error{
+		&linebot.APIError{Code: http.StatusTooManyRequests},
+		&linebot.APIError{Code: http.StatusInternalServerError},
+		errors.New("connection reset"),
+	}
+	line.errors["bob"] = []error{&linebot.APIError{Code: http.StatusBadRequest}}
+
+	var lock sync.Mutex
+	failed := make(map[string]int)
+	outbox := NewOutbox(line.push, func(to string, err error) {
+		lock.Lock()
+		failed[to]++
+		lock.Unlock()
+	})
+	outbox.backoff = time.Millisecond
+
+	outbox.Push("alice", texts("x", 3)...)
+	outbox.Push("alice", texts("y", 4)...)
+	outbox.Push("bob", texts("z", 7)...)
+	within(t, 5*time.Second, "flush", func() {
+		outbox.Flush(ctx)
+	})
+
+	var got []string
+	for _, batch := range line.batches["alice"] {
+		if len(batch) > outboxBatchSize {
+			t.Errorf("batch of %d messages", len(batch))
+		}
+		got = append(got, batch...)
+	}
+	want := []string{"xa", "xb", "xc", "ya", "yb", "yc", "yd"}
+	if len(got) != len(want) {
+		t.Fatalf("alice got %v, expected %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("alice got %v, expected %v", got, want)
+		}
+	}
+	if failed["alice"] != 0 {
+		t.Errorf("transient errors to alice are reported as failures")
+	}
+
+	// The first batch to bob fails for good, the rest still goes out
+	if failed["bob"] != 1 {
+		t.Errorf("%d failures reported for bob, expected 1", failed["bob"])
+	}
+	if len(line.batches["bob"]) != 1 || len(line.batches["bob"][0]) != 2 {
+		t.Errorf("bob got %v, expected the last 2 messages", line.batches["bob"])
+	}
+}
+
+func TestOutboxRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &RetryAfterTransport{}}
+	_, err := client.Get(server.URL)
+	if after, ok := retryAfter(err); !ok || after != 3*time.Second {
+		t.Fatalf("429 with Retry-After returned %v", err)
+	}
+
+	// LINE asks for less than the backoff, which would not finish in time
+	line := newFakeLine()
+	line.errors["alice"] = []error{&url.Error{Op: "Post", URL: server.URL, Err: &RetryAfterError{After: 10 * time.Millisecond}}}
+	outbox := NewOutbox(line.push, nil)
+	outbox.backoff = time.Hour
+	outbox.Push("alice", texts("x", 1)...)
+	within(t, 5*time.Second, "flush", func() {
+		outbox.Flush(ctx)
+	})
+	if len(line.batches["alice"]) != 1 {
+		t.Errorf("alice got %v, expected 1 batch", line.batches["alice"])
+	}
+}
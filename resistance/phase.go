@@ -0,0 +1,381 @@
+package resistance
+
+import (
+	"time"
+
+	"github.com/azaky/resistancebot/logging"
+)
+
+// The daemon is a state machine. Each State of the game has a phase, which
+// says what happens when the game enters and leaves it, which commands it
+// accepts and which timers run while the game is in it. New phases are added
+// by registering them in init, see the ones below.
+
+// stay is returned by command and timer handlers that keep the game in its
+// current phase.
+const stay State = -1
+
+// commandHandler serves a command and returns the state the game moves to.
+// The error is sent back to the caller.
+type commandHandler func(game *Game, cmd *command) (State, error)
+
+type phaseTimer struct {
+	// name is only used for logging
+	name string
+	// after is how long after entering the phase the timer fires. It is
+	// evaluated every time the phase is entered.
+	after func() time.Duration
+	// fire returns the state the game moves to
+	fire func(game *Game) State
+}
+
+type phase struct {
+	// enter is called when the game moves into the phase
+	enter func(game *Game)
+	// announce is called phaseDelay after enter, giving players time to
+	// read what happened before. Until then, only commonCommands are
+	// served and the timers don't run.
+	announce func(game *Game)
+	// resume is called instead of enter and announce when a restored game
+	// picks up in the phase, see Resume
+	resume func(game *Game)
+	// exit is called when the game leaves the phase, including when it is
+	// aborted
+	exit     func(game *Game)
+	commands map[commandKind]commandHandler
+	timers   []phaseTimer
+}
+
+var phases = make(map[State]*phase)
+
+func registerPhase(state State, p *phase) {
+	phases[state] = p
+}
+
+// commonCommands are accepted in every phase. A phase may override them.
+var commonCommands = map[commandKind]commandHandler{
+	cmdAbort: func(game *Game, cmd *command) (State, error) {
+		if err := game.abort(cmd.playerID); err != nil {
+			return stay, err
+		}
+		return STATE_IDLE, nil
+	},
+	cmdShowPlayers: func(game *Game, cmd *command) (State, error) {
+		game.showPlayers()
+		return stay, nil
+	},
+	cmdInfo: func(game *Game, cmd *command) (State, error) {
+		game.info()
+		return stay, nil
+	},
+	cmdReachable: func(game *Game, cmd *command) (State, error) {
+		game.setReachable(cmd.playerID, cmd.value)
+		return stay, nil
+	},
+	cmdPing: func(game *Game, cmd *command) (State, error) {
+		return stay, nil
+	},
+	cmdSuspend: func(game *Game, cmd *command) (State, error) {
+		game.suspend()
+		return STATE_IDLE, nil
+	},
+}
+
+// startIfReady starts the game once everyone in the lobby is ready, see
+// Game.Ready. It returns the state the game moves to.
+func startIfReady(game *Game, starter string) State {
+	if !game.allReady() || game.start(starter) != nil {
+		return stay
+	}
+	return STATE_PICK
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+func init() {
+	registerPhase(STATE_INITIALIZED, &phase{
+		commands: map[commandKind]commandHandler{
+			cmdAddPlayer: func(game *Game, cmd *command) (State, error) {
+				return stay, game.addPlayer(cmd.player)
+			},
+			cmdKick: func(game *Game, cmd *command) (State, error) {
+				if err := game.kick(cmd.playerID); err != nil {
+					return stay, err
+				}
+				// The kicked may have been the only ones not ready
+				return startIfReady(game, cmd.playerID), nil
+			},
+			cmdReady: func(game *Game, cmd *command) (State, error) {
+				if err := game.ready(cmd.playerID); err != nil {
+					return stay, err
+				}
+				return startIfReady(game, cmd.playerID), nil
+			},
+			cmdExtend: func(game *Game, cmd *command) (State, error) {
+				if err := game.extend(cmd.playerID); err != nil {
+					return stay, err
+				}
+				// Entering the lobby again restarts its timers
+				return STATE_INITIALIZED, nil
+			},
+			cmdStart: func(game *Game, cmd *command) (State, error) {
+				if err := game.start(cmd.playerID); err != nil {
+					return stay, err
+				}
+				return STATE_PICK, nil
+			},
+		},
+		timers: []phaseTimer{
+			{
+				name:  "init30Timer",
+				after: func() time.Duration { return seconds(conf.GameInitializationTime - 30) },
+				fire: func(game *Game) State {
+					go game.OnStartWarning(game.Snapshot(), 30)
+					return stay
+				},
+			},
+			{
+				name:  "init15Timer",
+				after: func() time.Duration { return seconds(conf.GameInitializationTime - 15) },
+				fire: func(game *Game) State {
+					go game.OnStartWarning(game.Snapshot(), 15)
+					return stay
+				},
+			},
+			{
+				name:  "initTimer",
+				after: func() time.Duration { return seconds(conf.GameInitializationTime) },
+				fire: func(game *Game) State {
+					// Whoever is left starts, ready or not, so
+					// startIfReady is not needed after the drop
+					game.dropUnconfirmed()
+					if game.state.NPlayers < conf.GameMinPlayers && game.extend("timer") == nil {
+						return STATE_INITIALIZED
+					}
+					if game.start("timer") != nil {
+						game.abort("system")
+						return STATE_IDLE
+					}
+					return STATE_PICK
+				},
+			},
+		},
+	})
+
+	registerPhase(STATE_PICK, &phase{
+		enter:    (*Game).startPick,
+		announce: (*Game).announcePick,
+		resume:   (*Game).announcePick,
+		commands: map[commandKind]commandHandler{
+			cmdPick: func(game *Game, cmd *command) (State, error) {
+				return stay, game.pick(cmd.playerID, cmd.targetID)
+			},
+			cmdDonePick: func(game *Game, cmd *command) (State, error) {
+				if err := game.donePick(cmd.playerID); err != nil {
+					return stay, err
+				}
+				return STATE_VOTING, nil
+			},
+		},
+	})
+
+	registerPhase(STATE_VOTING, &phase{
+		enter:    (*Game).startVoting,
+		announce: (*Game).announceVoting,
+		resume:   (*Game).announceVoting,
+		commands: map[commandKind]commandHandler{
+			cmdVote: func(game *Game, cmd *command) (State, error) {
+				return stay, game.vote(cmd.playerID, cmd.value)
+			},
+		},
+		timers: []phaseTimer{
+			{
+				name:  "voting15Timer",
+				after: func() time.Duration { return seconds(conf.GameVotingTime - 15) },
+				fire: func(game *Game) State {
+					go game.OnVotingWarning(game.Snapshot(), 15)
+					return stay
+				},
+			},
+			{
+				name:  "votingTimer",
+				after: func() time.Duration { return seconds(conf.GameVotingTime) },
+				fire:  (*Game).finishVoting,
+			},
+		},
+	})
+
+	registerPhase(STATE_MISSION, &phase{
+		enter:    (*Game).startMission,
+		announce: (*Game).announceMission,
+		resume:   (*Game).announceMission,
+		commands: map[commandKind]commandHandler{
+			cmdExecuteMission: func(game *Game, cmd *command) (State, error) {
+				return stay, game.executeMission(cmd.playerID, cmd.value)
+			},
+		},
+		timers: []phaseTimer{
+			{
+				name:  "mission15Timer",
+				after: func() time.Duration { return seconds(conf.GameMissionTime - 15) },
+				fire: func(game *Game) State {
+					go game.OnMissionWarning(game.Snapshot(), 15)
+					return stay
+				},
+			},
+			{
+				name:  "missionTimer",
+				after: func() time.Duration { return seconds(conf.GameMissionTime) },
+				fire:  (*Game).finishMission,
+			},
+		},
+	})
+}
+
+func (game *Game) daemon() {
+	daemons.Inc()
+	defer daemons.Dec()
+	defer close(game.done)
+	if game.resumed {
+		game.OnResume(game.Snapshot())
+	} else {
+		game.OnCreate(game.Snapshot())
+	}
+
+	state := game.state.State
+	resumed := game.resumed
+	for state != STATE_IDLE {
+		p, ok := phases[state]
+		if !ok {
+			game.log().Errorf("Moved to unknown state %s, aborting", state)
+			game.abort("system")
+			return
+		}
+		state = game.run(state, p, resumed)
+		resumed = false
+	}
+}
+
+// run keeps the game in phase p until one of its commands or timers moves
+// the game to another state, which is returned. Timers of a resumed phase
+// start over.
+func (game *Game) run(state State, p *phase, resumed bool) State {
+	game.state.State = state
+	if resumed {
+		if p.resume != nil {
+			p.resume(game)
+		}
+	} else {
+		game.state.Phase++
+		if p.enter != nil {
+			p.enter(game)
+		}
+	}
+	game.log().Infof("Entered phase")
+	if p.exit != nil {
+		defer p.exit(game)
+	}
+
+	// fired is buffered so that a timer never blocks after the phase is over
+	fired := make(chan int, len(p.timers))
+	var timers []*time.Timer
+	defer func() {
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}()
+	startTimers := func() {
+		for i, t := range p.timers {
+			i := i
+			timers = append(timers, time.AfterFunc(t.after(), func() { fired <- i }))
+		}
+	}
+
+	// announce fires once the pause before announcing the phase is over.
+	// The daemon keeps answering meanwhile, see Health.
+	var announce <-chan time.Time
+	if p.announce == nil || resumed {
+		startTimers()
+	} else {
+		pause := time.NewTimer(phaseDelay)
+		defer pause.Stop()
+		announce = pause.C
+	}
+
+	for {
+		// Once killed, nothing else is acted upon
+		if game.killed() {
+			return STATE_IDLE
+		}
+		select {
+		case <-game.kill:
+			continue
+
+		case <-announce:
+			announce = nil
+			p.announce(game)
+			startTimers()
+
+		case cmd := <-game.commands:
+			if !game.receive(cmd) {
+				continue
+			}
+			next, err := game.handle(p, cmd, announce == nil)
+			cmd.reply <- err
+			if next != stay {
+				return next
+			}
+
+		case i := <-fired:
+			game.log().Debugf("Timer %s fired", p.timers[i].name)
+			if next := p.timers[i].fire(game); next != stay {
+				return next
+			}
+		}
+	}
+}
+
+// killed tells whether the game was killed, see Kill, and cleans it up if
+// so.
+func (game *Game) killed() bool {
+	select {
+	case <-game.kill:
+		game.log().Warnf("Killed")
+		game.cleanup()
+		return true
+	default:
+		return false
+	}
+}
+
+// receive takes the next command for the daemon. Commands whose caller has
+// already given up are answered and dropped here.
+func (game *Game) receive(cmd *command) bool {
+	l := logging.FromContext(cmd.ctx).WithFields(game.logFields())
+	if err := cmd.ctx.Err(); err != nil {
+		l.Infof("Dropping command %s: %s", cmd.kind, err.Error())
+		cmd.reply <- err
+		return false
+	}
+	if phase, ok := cmd.ctx.Value(phaseKey{}).(int); ok && phase != game.state.Phase {
+		l.Debugf("Dropping command %s from phase %d", cmd.kind, phase)
+		cmd.reply <- ErrExpired
+		return false
+	}
+	l.Debugf("Command %s from %s", cmd.kind, cmd.playerID)
+	return true
+}
+
+// handle serves cmd in phase p. The commands of the phase itself are only
+// served once it is announced.
+func (game *Game) handle(p *phase, cmd *command, announced bool) (State, error) {
+	if handler, ok := p.commands[cmd.kind]; ok && announced {
+		return handler(game, cmd)
+	}
+	if handler, ok := commonCommands[cmd.kind]; ok {
+		return handler(game, cmd)
+	}
+	return stay, rejections[cmd.kind]
+}
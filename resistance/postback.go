@@ -0,0 +1,68 @@
+package resistance
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/azaky/resistancebot/util"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// postbackSecret signs the buttons. It is kept apart from the channel secret,
+// which is what LINE signs the webhooks with. Without one configured, buttons
+// still can't be forged, but stop working when the bot restarts.
+var postbackSecret = conf.PostbackSecret
+
+func init() {
+	if postbackSecret == "" {
+		postbackSecret = newNonce() + newNonce()
+	}
+}
+
+// signPostback binds the postback data of a button to the current phase of
+// game. The data gets the phase and a signature appended, which also covers
+// the nonce of the game, so that buttons of an earlier game in the same
+// group don't work either.
+func signPostback(game *Snapshot, data string) string {
+	data = fmt.Sprintf("%s:%d", data, game.Phase)
+	return data + ":" + util.Sign(postbackSecret, game.nonce, data)
+}
+
+// signed wraps the handler of a button made with signPostback. The first
+// group of its pattern must be the game ID, and the last two the phase and
+// the signature, which are not passed on to handler. Commands of handler
+// must be sent with the given context, so that they expire with the phase.
+func (b *LineBot) signed(handler messageHandler) messageHandler {
+	return func(ctx context.Context, event *linebot.Event, args ...string) {
+		n := len(args)
+		phase, signature := args[n-2], args[n-1]
+		game := LoadGame(args[1])
+		if game == nil {
+			b.reply(event, ErrExpired.Error())
+			return
+		}
+		data := strings.TrimSuffix(args[0], ":"+signature)
+		if !util.Verify(postbackSecret, signature, game.Snapshot().nonce, data) {
+			b.eventLogger(event).Infof("Bad signature on postback %s", args[0])
+			b.reply(event, ErrExpired.Error())
+			return
+		}
+		p, _ := strconv.Atoi(phase)
+		handler(WithPhase(ctx, p), event, args[:n-2]...)
+	}
+}
+
+// expiredButton answers buttons that can't be verified anymore.
+func (b *LineBot) expiredButton(ctx context.Context, event *linebot.Event, args ...string) {
+	b.reply(event, ErrExpired.Error())
+}
+
+// buttonCommand is command for signed buttons, telling the user when the
+// button has expired.
+func (b *LineBot) buttonCommand(ctx context.Context, event *linebot.Event, id string, f func(ctx context.Context) error) {
+	if err := b.command(ctx, id, f); err == ErrExpired {
+		b.reply(event, err.Error())
+	}
+}
@@ -0,0 +1,52 @@
+package resistance
+
+import (
+	"context"
+
+	"github.com/azaky/resistancebot/util"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// offerRematch asks the group of a finished game whether to play again
+// with the same players. The buttons only work for the last game of the
+// group, see rematch.
+func (b *LineBot) offerRematch(game *Snapshot) {
+	b.pushPostback(game.ID,
+		"Rematch?",
+		"Play again with the same players",
+		pair{"Rematch", ".rematch:" + game.nonce},
+		pair{"Rematch, next leader", ".rematch:" + game.nonce + ":rotate"},
+	)
+}
+
+func (b *LineBot) rematch(ctx context.Context, event *linebot.Event, args ...string) {
+	if event.Source.Type == linebot.EventSourceTypeUser {
+		// don't bother reply
+		return
+	}
+	id := util.GetGameID(event.Source)
+	previous := b.LastFinished(id)
+	if previous == nil || previous.nonce != args[1] {
+		b.reply(event, ErrExpired.Error())
+		return
+	}
+	if previous.FindPlayerByID(event.Source.UserID) == nil {
+		b.reply(event, "Only players of the last game can ask for a rematch")
+		return
+	}
+	if GameExistsByID(id) {
+		b.reply(event, "A game is already created")
+		return
+	}
+
+	user, err := b.getUserInfo(event.Source)
+	if err != nil {
+		b.warnIncompatibility(event)
+		return
+	}
+	game := NewRematch(id, previous, args[2] != "", b.handlers)
+	// Asking for the rematch confirms it
+	b.command(ctx, id, func(ctx context.Context) error {
+		return game.AddPlayer(ctx, b.getPlayerFromUser(user))
+	})
+}
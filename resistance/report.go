@@ -0,0 +1,156 @@
+package resistance
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/azaky/resistancebot/util"
+	"github.com/line/line-bot-sdk-go/linebot"
+	cache "github.com/patrickmn/go-cache"
+)
+
+// reportName is the name of player in the post-game report, where roles
+// are no longer hidden.
+func reportName(player *Player) string {
+	if player.Role == ROLE_SPY {
+		return player.Name + " (spy)"
+	}
+	return player.Name
+}
+
+func reportNames(players []*Player) []string {
+	var names []string
+	for _, player := range players {
+		names = append(names, reportName(player))
+	}
+	return names
+}
+
+// newReportMessage tells the whole story of a finished game: every team
+// voted on and how everyone voted, and who played Fail on each mission.
+func newReportMessage(game *Snapshot) reportMessage {
+	data := reportMessage{
+		SpyWon:     game.SpyWin(),
+		Highlights: highlights(game),
+	}
+	for _, player := range game.Players {
+		if player.Role == ROLE_SPY {
+			data.Spies = append(data.Spies, player.Name)
+		}
+	}
+
+	rounds := make(map[int]*reportRound)
+	round := func(n int) *reportRound {
+		if rounds[n] == nil {
+			rounds[n] = &reportRound{Round: n}
+		}
+		return rounds[n]
+	}
+	for _, p := range game.Proposals {
+		approve, reject, notVoted := p.Voters(game.Players)
+		r := round(p.Round)
+		r.Proposals = append(r.Proposals, reportProposal{
+			VotingRound: p.VotingRound,
+			Leader:      reportName(p.Leader),
+			Team:        reportNames(p.Team),
+			Approve:     reportNames(approve),
+			Reject:      reportNames(reject),
+			NotVoted:    reportNames(notVoted),
+			Approved:    p.Approved,
+		})
+	}
+	for _, mission := range game.Missions {
+		r := round(mission.Round)
+		r.Executed = true
+		r.Success = mission.Success
+		for _, member := range mission.Members {
+			if !mission.Votes[member.ID] {
+				r.Failed = append(r.Failed, reportName(member))
+			}
+		}
+	}
+	for n := 1; n <= len(rounds); n++ {
+		if r, ok := rounds[n]; ok {
+			data.Rounds = append(data.Rounds, *r)
+		}
+	}
+	return data
+}
+
+func hasSpy(players []*Player) bool {
+	for _, player := range players {
+		if player.Role == ROLE_SPY {
+			return true
+		}
+	}
+	return false
+}
+
+// highlights points out notable play in a finished game.
+func highlights(game *Snapshot) []string {
+	var spyTeams []*Proposal
+	for _, p := range game.Proposals {
+		if hasSpy(p.Team) {
+			spyTeams = append(spyTeams, p)
+		}
+	}
+
+	var list []string
+	for _, player := range game.Players {
+		spy := player.Role == ROLE_SPY
+		if len(spyTeams) >= 2 {
+			consistent := true
+			for _, p := range spyTeams {
+				// Not voting counts as Reject
+				if p.Votes[player.ID] != spy {
+					consistent = false
+					break
+				}
+			}
+			if consistent && spy {
+				list = append(list, fmt.Sprintf("Spy %s approved every team with a spy", player.Name))
+			} else if consistent {
+				list = append(list, fmt.Sprintf("%s rejected every team with a spy", player.Name))
+			}
+		}
+		if spy {
+			missions, fails := 0, 0
+			for _, mission := range game.Missions {
+				if mission.HasMember(player.ID) {
+					missions++
+					if !mission.Votes[player.ID] {
+						fails++
+					}
+				}
+			}
+			if missions >= 2 && fails == 0 {
+				list = append(list, fmt.Sprintf("Spy %s went on %d missions and never played Fail", player.Name, missions))
+			}
+		}
+	}
+	return list
+}
+
+// report sends the post-game report to the group, and keeps the game for
+// .lastgame and rematches.
+func (b *LineBot) report(game *Snapshot) {
+	b.finished.Set(game.ID, game, cache.DefaultExpiration)
+	b.push(game.ID, b.templates.render("report", newReportMessage(game)))
+}
+
+// LastFinished returns the last game finished in the group id, if any. It
+// is kept for a week.
+func (b *LineBot) LastFinished(id string) *Snapshot {
+	if game, ok := b.finished.Get(id); ok {
+		return game.(*Snapshot)
+	}
+	return nil
+}
+
+func (b *LineBot) lastGame(ctx context.Context, event *linebot.Event, args ...string) {
+	if game := b.LastFinished(util.GetGameID(event.Source)); game != nil {
+		b.reply(event, b.templates.render("report", newReportMessage(game)))
+		return
+	}
+	b.reply(event, b.templates.render("no_report", nil))
+}
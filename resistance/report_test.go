@@ -0,0 +1,50 @@
+package resistance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	alice := &Player{ID: "a", Name: "Alice", Role: ROLE_SPY}
+	bob := &Player{ID: "b", Name: "Bob", Role: ROLE_RESISTANCE}
+	carol := &Player{ID: "c", Name: "Carol", Role: ROLE_RESISTANCE}
+	s := &Snapshot{
+		Players: []*Player{alice, bob, carol},
+		Config:  &Config{NRounds: 1},
+		Proposals: []*Proposal{
+			{Round: 1, VotingRound: 1, Leader: alice, Team: []*Player{alice, bob},
+				Votes: map[string]bool{"a": true, "b": true, "c": false}},
+			{Round: 1, VotingRound: 2, Leader: bob, Team: []*Player{alice, carol},
+				Votes: map[string]bool{"a": true, "b": true}, Approved: true},
+		},
+		Missions: []*Mission{
+			{Round: 1, Members: []*Player{alice, carol}, Votes: map[string]bool{"a": false, "c": true}, MinFail: 1},
+		},
+	}
+
+	data := newReportMessage(s)
+	if !data.SpyWon || !reflect.DeepEqual(data.Spies, []string{"Alice"}) {
+		t.Errorf("unexpected outcome %v, spies %v", data.SpyWon, data.Spies)
+	}
+	if len(data.Rounds) != 1 || len(data.Rounds[0].Proposals) != 2 {
+		t.Fatalf("unexpected rounds %+v", data.Rounds)
+	}
+	second := data.Rounds[0].Proposals[1]
+	if !reflect.DeepEqual(second.Reject, []string(nil)) || !reflect.DeepEqual(second.NotVoted, []string{"Carol"}) {
+		t.Errorf("unexpected votes %+v", second)
+	}
+	if !reflect.DeepEqual(data.Rounds[0].Failed, []string{"Alice (spy)"}) {
+		t.Errorf("Fail played by %v, expected Alice", data.Rounds[0].Failed)
+	}
+	expected := []string{
+		"Spy Alice approved every team with a spy",
+		"Carol rejected every team with a spy",
+	}
+	if !reflect.DeepEqual(data.Highlights, expected) {
+		t.Errorf("highlights are %q, expected %q", data.Highlights, expected)
+	}
+	if text := defaultTemplates.render("report", data); text == "" {
+		t.Errorf("report does not render")
+	}
+}
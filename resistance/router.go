@@ -0,0 +1,205 @@
+package resistance
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where a text command may be used.
+type commandScope int
+
+const (
+	SCOPE_ANY commandScope = iota
+	// SCOPE_GROUP: groups and multi-person chats
+	SCOPE_GROUP
+	// SCOPE_PRIVATE: private chat with the bot
+	SCOPE_PRIVATE
+)
+
+var scopeErrors = map[commandScope]string{
+	SCOPE_GROUP:   "This command only works in groups",
+	SCOPE_PRIVATE: "This command only works in a private chat with me",
+}
+
+type argKind int
+
+const (
+	// ARG_WORD: a single word
+	ARG_WORD argKind = iota
+	// ARG_INT: a whole number
+	ARG_INT
+	// ARG_CHOICE: one of the keys of argSpec.choices, passed on as the
+	// matching value
+	ARG_CHOICE
+	// ARG_TEXT: the rest of the message, spaces and newlines included. It
+	// must be the last argument.
+	ARG_TEXT
+)
+
+type argSpec struct {
+	name     string
+	kind     argKind
+	optional bool
+	choices  map[string]string
+}
+
+func (a argSpec) usage() string {
+	name := a.name
+	if a.kind == ARG_CHOICE {
+		var choices []string
+		for choice, value := range a.choices {
+			// Only show the canonical spelling
+			if choice == value {
+				choices = append(choices, choice)
+			}
+		}
+		sort.Strings(choices)
+		name = strings.Join(choices, "|")
+	}
+	if a.optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// textCommand is a command players type, e.g. ".players". The handler gets
+// the whole text in args[0], then the value of each argument in order, ""
+// for missing optional ones. Values are checked against their kind before
+// the handler is called.
+type textCommand struct {
+	name    string
+	aliases []string
+	args    []argSpec
+	help    string
+	scope   commandScope
+	// hidden commands are left out of .help, and ignored silently when
+	// used in the wrong scope
+	hidden  bool
+	handler messageHandler
+}
+
+func (c *textCommand) usage() string {
+	parts := []string{"." + c.name}
+	for _, arg := range c.args {
+		parts = append(parts, arg.usage())
+	}
+	return strings.Join(parts, " ")
+}
+
+// router finds the command for a text message. Commands are kept in
+// registration order, which is also the order of .help.
+type router struct {
+	commands []*textCommand
+	byName   map[string]*textCommand
+}
+
+func newRouter() *router {
+	return &router{byName: make(map[string]*textCommand)}
+}
+
+// register adds a command. Clashing names are programming errors, so they
+// panic.
+func (r *router) register(c *textCommand) {
+	for _, name := range append([]string{c.name}, c.aliases...) {
+		if _, exists := r.byName[name]; exists {
+			panic(fmt.Sprintf("command .%s registered twice", name))
+		}
+		r.byName[name] = c
+	}
+	r.commands = append(r.commands, c)
+}
+
+// route returns the command for text and its arguments. It returns a nil
+// command if text is not a command at all, and an error to show to the
+// user if the arguments don't fit.
+func (r *router) route(text string) (*textCommand, []string, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, ".") {
+		return nil, nil, nil
+	}
+	name, rest := splitWord(text[1:])
+	c, ok := r.byName[strings.ToLower(name)]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	args := []string{text}
+	for _, spec := range c.args {
+		var value string
+		if spec.kind == ARG_TEXT {
+			value, rest = rest, ""
+		} else {
+			value, rest = splitWord(rest)
+		}
+		if value == "" {
+			if !spec.optional {
+				return c, nil, fmt.Errorf("Usage: %s", c.usage())
+			}
+			args = append(args, "")
+			continue
+		}
+		switch spec.kind {
+		case ARG_INT:
+			if _, err := strconv.Atoi(value); err != nil {
+				return c, nil, fmt.Errorf("%s must be a number. Usage: %s", spec.name, c.usage())
+			}
+		case ARG_CHOICE:
+			choice, ok := spec.choices[strings.ToLower(value)]
+			if !ok {
+				return c, nil, fmt.Errorf("Usage: %s", c.usage())
+			}
+			value = choice
+		}
+		args = append(args, value)
+	}
+	if rest != "" {
+		return c, nil, fmt.Errorf("Usage: %s", c.usage())
+	}
+	return c, args, nil
+}
+
+func splitWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t\n"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+// help lists the visible commands, by scope.
+func (r *router) help() string {
+	sections := []struct {
+		scope commandScope
+		title string
+	}{
+		{SCOPE_ANY, "Anywhere:"},
+		{SCOPE_GROUP, "In groups:"},
+		{SCOPE_PRIVATE, "In private chat with me:"},
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("List of commands:")
+	for _, section := range sections {
+		var lines []string
+		for _, c := range r.commands {
+			if c.hidden || c.scope != section.scope {
+				continue
+			}
+			line := c.usage()
+			for _, alias := range c.aliases {
+				line += ", ." + alias
+			}
+			lines = append(lines, line+" : "+c.help)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		buffer.WriteString("\n\n" + section.title)
+		for _, line := range lines {
+			buffer.WriteString("\n" + line)
+		}
+	}
+	return buffer.String()
+}
@@ -0,0 +1,63 @@
+package resistance
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+func TestRouter(t *testing.T) {
+	nop := func(context.Context, *linebot.Event, ...string) {}
+	r := newRouter()
+	r.register(&textCommand{name: "players", aliases: []string{"p"}, help: "List players", scope: SCOPE_GROUP, handler: nop})
+	r.register(&textCommand{
+		name: "vote",
+		args: []argSpec{
+			{name: "round", kind: ARG_INT},
+			{name: "vote", kind: ARG_CHOICE, choices: map[string]string{"yes": "yes", "y": "yes", "no": "no"}},
+			{name: "comment", kind: ARG_TEXT, optional: true},
+		},
+		help:    "Vote",
+		scope:   SCOPE_PRIVATE,
+		handler: nop,
+	})
+	r.register(&textCommand{name: "secret", hidden: true, handler: nop})
+
+	tests := []struct {
+		text string
+		name string
+		args []string
+		err  bool
+	}{
+		{"hello", "", nil, false},
+		{".unknown", "", nil, false},
+		{" .P ", "players", []string{".P"}, false},
+		{".players now", "players", nil, true},
+		{".vote 2 Y", "vote", []string{".vote 2 Y", "2", "yes", ""}, false},
+		{".vote 2 no and\nmore", "vote", []string{".vote 2 no and\nmore", "2", "no", "and\nmore"}, false},
+		{".vote two yes", "vote", nil, true},
+		{".vote 2 maybe", "vote", nil, true},
+		{".vote 2", "vote", nil, true},
+	}
+	for _, test := range tests {
+		c, args, err := r.route(test.text)
+		name := ""
+		if c != nil {
+			name = c.name
+		}
+		if name != test.name || (err != nil) != test.err || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("route(%q) = %s, %q, %v", test.text, name, args, err)
+		}
+	}
+
+	help := r.help()
+	if !strings.Contains(help, ".players, .p : List players") || !strings.Contains(help, ".vote <round> <no|yes> [comment] : Vote") {
+		t.Errorf("unexpected help:\n%s", help)
+	}
+	if strings.Contains(help, "secret") {
+		t.Errorf("help shows hidden commands:\n%s", help)
+	}
+}
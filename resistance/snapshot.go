@@ -0,0 +1,197 @@
+package resistance
+
+// Snapshot is a copy of the state of a game at one point in time. The daemon
+// publishes a new snapshot on every change, and the published ones are
+// never modified again, so they can be read from any goroutine. Event
+// handlers receive the snapshot taken when the event happened.
+type Snapshot struct {
+	ID          string
+	Players     []*Player
+	NPlayers    int
+	State       State
+	Round       int
+	Picks       map[string]*Player
+	VotingRound int
+	Votes       map[string]bool
+	LeaderIndex int
+	Missions    []*Mission
+	Config      *Config
+	// Phase counts the phases the game has entered. Buttons are only good
+	// for the phase they were sent in, see signPostback.
+	Phase int
+
+	// Unconfirmed are the players of a rematch who have not joined yet,
+	// see NewRematch
+	Unconfirmed map[string]bool
+	// KeepSeating skips shuffling the players when the game starts
+	KeepSeating bool
+	// Ready are the players in the lobby who are ready to play
+	Ready map[string]bool
+	// Extensions counts how many times the lobby was extended
+	Extensions int
+	// Unreachable are the players who can't receive private messages, see
+	// Reachability and Game.Unreachable. It is not saved in checkpoints.
+	Unreachable map[string]bool
+
+	// Proposals are the teams voted on so far, oldest first
+	Proposals []*Proposal
+
+	spyWonByRejection bool
+	// nonce tells this game apart from earlier games in the same group
+	nonce string
+}
+
+// clone deep-copies the snapshot. Players referenced from picks and missions
+// point to the copied players.
+func (s *Snapshot) clone() *Snapshot {
+	c := *s
+
+	players := make(map[string]*Player)
+	c.Players = make([]*Player, len(s.Players))
+	for i, player := range s.Players {
+		p := *player
+		c.Players[i] = &p
+		players[p.ID] = &p
+	}
+
+	if s.Picks != nil {
+		c.Picks = make(map[string]*Player)
+		for id := range s.Picks {
+			c.Picks[id] = players[id]
+		}
+	}
+
+	if s.Unconfirmed != nil {
+		c.Unconfirmed = make(map[string]bool)
+		for id := range s.Unconfirmed {
+			c.Unconfirmed[id] = true
+		}
+	}
+
+	if s.Ready != nil {
+		c.Ready = make(map[string]bool)
+		for id := range s.Ready {
+			c.Ready[id] = true
+		}
+	}
+
+	if s.Unreachable != nil {
+		c.Unreachable = make(map[string]bool)
+		for id := range s.Unreachable {
+			c.Unreachable[id] = true
+		}
+	}
+
+	if s.Votes != nil {
+		c.Votes = make(map[string]bool)
+		for id, vote := range s.Votes {
+			c.Votes[id] = vote
+		}
+	}
+
+	c.Missions = make([]*Mission, len(s.Missions))
+	for i, mission := range s.Missions {
+		m := *mission
+		m.Members = make([]*Player, len(mission.Members))
+		for j, member := range mission.Members {
+			m.Members[j] = players[member.ID]
+		}
+		m.Votes = make(map[string]bool)
+		for id, vote := range mission.Votes {
+			m.Votes[id] = vote
+		}
+		c.Missions[i] = &m
+	}
+
+	c.Proposals = make([]*Proposal, len(s.Proposals))
+	for i, proposal := range s.Proposals {
+		p := *proposal
+		p.Leader = players[proposal.Leader.ID]
+		p.Team = make([]*Player, len(proposal.Team))
+		for j, member := range proposal.Team {
+			p.Team[j] = players[member.ID]
+		}
+		p.Votes = make(map[string]bool)
+		for id, vote := range proposal.Votes {
+			p.Votes[id] = vote
+		}
+		c.Proposals[i] = &p
+	}
+
+	return &c
+}
+
+func (s *Snapshot) FindPlayerByID(id string) *Player {
+	for _, player := range s.Players {
+		if player.ID == id {
+			return player
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) leader() *Player {
+	return s.Players[s.LeaderIndex]
+}
+
+// GetPicks returns the picked players in seating order.
+func (s *Snapshot) GetPicks() []*Player {
+	var picks []*Player
+	for _, player := range s.Players {
+		if pick, ok := s.Picks[player.ID]; ok {
+			picks = append(picks, pick)
+		}
+	}
+	return picks
+}
+
+func (s *Snapshot) CurrentMission() *Mission {
+	if s.State != STATE_MISSION {
+		return nil
+	}
+	return s.Missions[len(s.Missions)-1]
+}
+
+func (s *Snapshot) SpyWin() bool {
+	if s.Config == nil {
+		return false
+	}
+	if s.spyWonByRejection {
+		return true
+	}
+	success := 0
+	fail := 0
+	for _, mission := range s.Missions {
+		if mission.Success {
+			success++
+		} else {
+			fail++
+		}
+	}
+	success += s.Config.NRounds - len(s.Missions)
+	return fail > success
+}
+
+func (s *Snapshot) ResistanceWin() bool {
+	if s.Config == nil {
+		return false
+	}
+	if s.spyWonByRejection {
+		return false
+	}
+	success := 0
+	fail := 0
+	for _, mission := range s.Missions {
+		if mission.Success {
+			success++
+		} else {
+			fail++
+		}
+	}
+	fail += s.Config.NRounds - len(s.Missions)
+	return success > fail
+}
+
+func (s *Snapshot) Over() bool {
+	return s.SpyWin() || s.ResistanceWin()
+}
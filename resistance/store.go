@@ -0,0 +1,104 @@
+package resistance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/azaky/resistancebot/logging"
+)
+
+// Store keeps the checkpoints of suspended games across restarts.
+type Store interface {
+	Save(c *Checkpoint) error
+	LoadAll() ([]*Checkpoint, error)
+	Delete(id string) error
+	// Check returns an error if checkpoints can't be saved
+	Check() error
+}
+
+// FileStore keeps one JSON file per game in a directory.
+type FileStore struct {
+	dir string
+}
+
+const checkpointExt = ".json"
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (fs *FileStore) path(id string) string {
+	return filepath.Join(fs.dir, url.PathEscape(id)+checkpointExt)
+}
+
+func (fs *FileStore) Save(c *Checkpoint) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a crash never leaves a
+	// truncated checkpoint behind
+	tmp, err := ioutil.TempFile(fs.dir, ".checkpoint")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path(c.ID))
+}
+
+func (fs *FileStore) LoadAll() ([]*Checkpoint, error) {
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoints []*Checkpoint
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), checkpointExt) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(fs.dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var c Checkpoint
+		if err := json.Unmarshal(data, &c); err != nil {
+			// Don't let one broken file hold back the other games
+			logging.With("component", "store").Warnf("Skipping %s: %s", file.Name(), err.Error())
+			continue
+		}
+		checkpoints = append(checkpoints, &c)
+	}
+	return checkpoints, nil
+}
+
+func (fs *FileStore) Delete(id string) error {
+	err := os.Remove(fs.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *FileStore) Check() error {
+	tmp, err := ioutil.TempFile(fs.dir, ".check")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
@@ -0,0 +1,619 @@
+package resistance
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/azaky/resistancebot/logging"
+)
+
+// Templates holds the text/template bodies used by LineBot to render every
+// game message. Each template can be overridden by an operator by placing a
+// file named "<name>.tmpl" in the template directory.
+type Templates struct {
+	templates map[string]*template.Template
+}
+
+type templateSpec struct {
+	Text string
+	// Samples are rendered when a template is loaded, so that overrides
+	// referencing unknown fields are rejected at startup instead of in the
+	// middle of a game. Together they must reach every branch of the
+	// built-in template, see unreachedBranches.
+	Samples []interface{}
+}
+
+type playerView struct {
+	Number      int
+	Name        string
+	Leader      bool
+	Spy         bool
+	Unconfirmed bool
+}
+
+type readyMessage struct {
+	Name  string
+	Ready int
+	Total int
+}
+
+type extendMessage struct {
+	// Name is who extended, empty when the timer did
+	Name    string
+	Seconds int
+	// Left is how many more times the lobby can be extended
+	Left int
+	// Missing is how many more players are needed to start
+	Missing int
+}
+
+type rematchMessage struct {
+	Names   []string
+	Seconds int
+}
+
+type voteView struct {
+	Name    string
+	Approve bool
+}
+
+type secondsMessage struct {
+	Seconds int
+}
+
+type abortMessage struct {
+	Aborter string
+}
+
+type startMessage struct {
+	Starter string
+}
+
+type configMessage struct {
+	NResistances int
+	NSpies       int
+	NRounds      int
+	Overview     []string
+}
+
+type roleMessage struct {
+	Name  string
+	Spies []string
+}
+
+type infoMessage struct {
+	NResistances int
+	NSpies       int
+	Round        int
+	VotingRound  int
+	Overview     []string
+	// Stage is one of "pick", "voting", "mission" or empty.
+	Stage string
+	Team  []string
+}
+
+type playerMessage struct {
+	Name string
+}
+
+type namesMessage struct {
+	Names []string
+}
+
+type playersMessage struct {
+	Players []playerView
+}
+
+type pickMessage struct {
+	Round       int
+	VotingRound int
+	Leader      string
+	Player      string
+	Required    string
+	Team        []string
+	// Players are all players in seating order, for .pick
+	Players []string
+}
+
+type votingMessage struct {
+	Round       int
+	VotingRound int
+	Leader      string
+	Members     []playerView
+	Seconds     int
+}
+
+type voteMessage struct {
+	Approve bool
+}
+
+type votingDoneMessage struct {
+	Votes     []voteView
+	NotVoted  int
+	Majority  bool
+	LastRound bool
+}
+
+type missionMessage struct {
+	Round    int
+	Members  []string
+	Seconds  int
+	Success  bool
+	NSuccess int
+	NFail    int
+}
+
+type executeMissionMessage struct {
+	Success    bool
+	Resistance bool
+}
+
+type linkMessage struct {
+	URL string
+}
+
+type gameOverMessage struct {
+	// Rejections is how many teams in a row were rejected, when that is
+	// what ended the game
+	Rejections int
+}
+
+func newGameOverMessage(game *Snapshot) gameOverMessage {
+	if game.spyWonByRejection {
+		return gameOverMessage{game.VotingRound}
+	}
+	return gameOverMessage{}
+}
+
+type resumeMessage struct {
+	// Stage is one of "pick", "voting", "mission" or empty if the game
+	// has not started.
+	Stage       string
+	Round       int
+	VotingRound int
+}
+
+type proposalView struct {
+	Round       int
+	VotingRound int
+	Leader      string
+	Team        []string
+	Approve     []string
+	Reject      []string
+	NotVoted    []string
+	Approved    bool
+	// MissionDone is set once the mission of an approved team is over
+	MissionDone    bool
+	MissionSuccess bool
+	NFail          int
+}
+
+type historyMessage struct {
+	Proposals []proposalView
+}
+
+type reportProposal struct {
+	VotingRound int
+	Leader      string
+	Team        []string
+	Approve     []string
+	Reject      []string
+	NotVoted    []string
+	Approved    bool
+}
+
+type reportRound struct {
+	Round     int
+	Proposals []reportProposal
+	Executed  bool
+	Success   bool
+	// Failed are the members who played Fail
+	Failed []string
+}
+
+type reportMessage struct {
+	SpyWon     bool
+	Spies      []string
+	Rounds     []reportRound
+	Highlights []string
+}
+
+var sampleReport = reportMessage{
+	SpyWon: true,
+	Spies:  []string{"Alice"},
+	Rounds: []reportRound{
+		{
+			Round: 1,
+			Proposals: []reportProposal{
+				{1, "Alice (spy)", sampleNames, []string{"Alice (spy)"}, []string{"Bob"}, []string{"Carol"}, false},
+				{2, "Bob", sampleNames, sampleNames, nil, nil, true},
+			},
+			Executed: true,
+			Failed:   []string{"Alice (spy)"},
+		},
+		{Round: 2, Executed: true, Success: true},
+	},
+	Highlights: []string{"Spy Alice approved every team with a spy"},
+}
+
+var sampleProposals = []proposalView{
+	{1, 1, "Alice", sampleNames, []string{"Alice"}, []string{"Bob"}, []string{"Carol"}, false, false, false, 0},
+	{1, 2, "Bob", sampleNames, sampleNames, nil, []string{"Carol"}, true, true, false, 1},
+	{2, 1, "Carol", sampleNames, nil, sampleNames, nil, false, false, false, 0},
+	{2, 2, "Alice", sampleNames, sampleNames, nil, nil, true, true, true, 0},
+}
+
+var templateFuncs = template.FuncMap{
+	"inc":  func(i int) int { return i + 1 },
+	"join": strings.Join,
+}
+
+var samplePlayers = []playerView{
+	{Number: 1, Name: "Alice", Leader: true, Spy: true},
+	{Number: 2, Name: "Bob", Unconfirmed: true},
+}
+
+var sampleNames = []string{"Alice", "Bob"}
+
+var templateSpecs = map[string]templateSpec{
+	"create": {
+		Text:    "Game will be started in {{.Seconds}} seconds. Commands:",
+		Samples: []interface{}{secondsMessage{120}},
+	},
+	"ready": {
+		Text:    "{{.Name}} is ready ({{.Ready}}/{{.Total}}). The game starts once everyone is ready.",
+		Samples: []interface{}{readyMessage{"Alice", 1, 5}},
+	},
+	"extend": {
+		Text: "{{if .Name}}{{.Name}} extended the waiting time.{{else if gt .Missing 0}}Not enough players yet, {{.Missing}} more needed. Waiting a bit longer.{{end}}" +
+			" Game will be started in {{.Seconds}} seconds.{{if gt .Left 0}} Type \".extend\" to wait longer ({{.Left}} more time(s)).{{end}}",
+		Samples: []interface{}{extendMessage{"Alice", 120, 2, 0}, extendMessage{"", 120, 0, 2}},
+	},
+	"rematch": {
+		Text:    "Rematch! {{join .Names \", \"}}: press Join within {{.Seconds}} seconds to play again. Commands:",
+		Samples: []interface{}{rematchMessage{sampleNames, 120}},
+	},
+	"drop": {
+		Text:    "{{join .Names \", \"}} did not join the rematch, and left the game.",
+		Samples: []interface{}{namesMessage{sampleNames}},
+	},
+	"abort": {
+		Text:    "{{if .Aborter}}Game aborted by {{.Aborter}}{{else}}Game aborted.{{end}}",
+		Samples: []interface{}{abortMessage{"Alice"}, abortMessage{}},
+	},
+	"start": {
+		Text:    "{{if .Starter}}Game started by {{.Starter}}. Check your PM to find out your role{{else}}Game started. Check your PM to find out your role{{end}}",
+		Samples: []interface{}{startMessage{"Alice"}, startMessage{}},
+	},
+	"start_config": {
+		Text:    "There are {{.NResistances}} resistances, and {{.NSpies}} spies.\n\nThere are {{.NRounds}} missions to be executed, each requires {{join .Overview \", \"}} members each (* means that the mission requires at least 2 fails to sabotage it)",
+		Samples: []interface{}{configMessage{3, 2, 5, []string{"2", "3", "2", "3", "3"}}},
+	},
+	"role_resistance": {
+		Text:    "{{.Name}}, you are a Resistance. You'll win if at least 3 missions are successful.",
+		Samples: []interface{}{roleMessage{Name: "Alice"}},
+	},
+	"role_spy": {
+		Text:    "{{.Name}}, you are a Spy. You'll win if at least 3 missions are failed.\n\nThe other spies: {{join .Spies \", \"}}",
+		Samples: []interface{}{roleMessage{"Alice", []string{"Bob"}}, roleMessage{Name: "Alice"}},
+	},
+	"companion_link": {
+		Text:    "Buttons not showing up? You can also play from your browser:\n{{.URL}}",
+		Samples: []interface{}{linkMessage{"https://example.com/play/game/player/signature"}},
+	},
+	"info": {
+		Text: "Game info:\n\n{{.NSpies}} spies, {{.NResistances}} resistances." +
+			"\n\nMission #{{.Round}}, Leader #{{.VotingRound}}\nMembers required for each mission:\n{{join .Overview \", \"}}" +
+			"{{if eq .Stage \"pick\"}}\n\nCurrent Stage: Leader chooses team. Current team:{{range $i, $name := .Team}}\n{{inc $i}}. {{$name}}{{else}}\n(no one yet){{end}}" +
+			"{{else if eq .Stage \"voting\"}}\n\nCurrent Stage: Vote on team:{{range $i, $name := .Team}}\n{{inc $i}}. {{$name}}{{end}}" +
+			"{{else if eq .Stage \"mission\"}}\n\nCurrent Stage: Mission Execution. Members:{{range $i, $name := .Team}}\n{{inc $i}}. {{$name}}{{end}}{{end}}",
+		Samples: []interface{}{
+			infoMessage{3, 2, 1, 1, []string{"(2)", "3"}, "pick", sampleNames},
+			infoMessage{3, 2, 1, 1, []string{"(2)", "3"}, "pick", nil},
+			infoMessage{3, 2, 1, 1, []string{"(2)", "3"}, "voting", sampleNames},
+			infoMessage{3, 2, 1, 1, []string{"(2)", "3"}, "mission", sampleNames},
+			infoMessage{},
+		},
+	},
+	"add_player": {
+		Text:    "{{.Name}} is added to the game.",
+		Samples: []interface{}{playerMessage{"Alice"}},
+	},
+	"kick": {
+		Text:    "{{join .Names \", \"}} removed from the game.",
+		Samples: []interface{}{namesMessage{sampleNames}},
+	},
+	"players": {
+		Text:    "Players:{{range .Players}}\n{{.Number}}. {{.Name}}{{if .Leader}} (leader){{end}}{{if .Unconfirmed}} (not joined yet){{end}}{{end}}",
+		Samples: []interface{}{playersMessage{samplePlayers}},
+	},
+	"players_revealed": {
+		Text:    "Here are players and their roles:{{range .Players}}\n{{.Number}}. {{.Name}} ({{if .Spy}}Spy{{else}}Resistance{{end}}){{end}}",
+		Samples: []interface{}{playersMessage{samplePlayers}},
+	},
+	"start_pick": {
+		Text:    "[Leader chooses team]\n[Mission #{{.Round}}, Leader #{{.VotingRound}}]\n\nCurrent leader is {{.Leader}}. He/she will choose {{.Required}} people for this mission. For leader, check your PM",
+		Samples: []interface{}{pickMessage{Round: 1, VotingRound: 1, Leader: "Alice", Required: "2"}},
+	},
+	"start_pick_pm": {
+		Text: "[Leader chooses team]\n[Mission #{{.Round}}, Leader #{{.VotingRound}}]\n\nYou are the current leader. Choose people you trust the most to go for the mission. This mission needs {{.Required}} people. Click \"Done\" when you're done.\n\nChoose wisely." +
+			"{{if .Players}}\n\nNo buttons? Type \".pick <number>\" to choose a player, then \".done\":{{range $i, $name := .Players}}\n{{inc $i}}. {{$name}}{{end}}{{end}}",
+		Samples: []interface{}{pickMessage{Round: 1, VotingRound: 1, Leader: "Alice", Required: "2", Players: sampleNames}},
+	},
+	"pick": {
+		Text:    "{{.Leader}} chooses {{.Player}}.\n\nCurrent team (need {{.Required}} people):{{range $i, $name := .Team}}\n{{inc $i}}. {{$name}}{{end}}",
+		Samples: []interface{}{pickMessage{1, 1, "Alice", "Bob", "2", sampleNames, nil}},
+	},
+	"pick_pm": {
+		Text:    "You choose {{.Player}}.\n\nCurrent team (need {{.Required}} people):{{range $i, $name := .Team}}\n{{inc $i}}. {{$name}}{{end}}",
+		Samples: []interface{}{pickMessage{1, 1, "Alice", "Bob", "2", sampleNames, nil}},
+	},
+	"unpick": {
+		Text:    "{{.Leader}} cancels {{.Player}}.\n\nCurrent team (need {{.Required}} people):{{range $i, $name := .Team}}\n{{inc $i}}. {{$name}}{{else}}\n(no members yet){{end}}",
+		Samples: []interface{}{pickMessage{1, 1, "Alice", "Bob", "2", sampleNames, nil}, pickMessage{}},
+	},
+	"unpick_pm": {
+		Text:    "You cancel {{.Player}}.\n\nCurrent team (need {{.Required}} people):{{range $i, $name := .Team}}\n{{inc $i}}. {{$name}}{{else}}\n(no members yet){{end}}",
+		Samples: []interface{}{pickMessage{1, 1, "Alice", "Bob", "2", sampleNames, nil}, pickMessage{}},
+	},
+	"start_voting": {
+		Text:    "[Vote on team]\n[Mission #{{.Round}}, Leader #{{.VotingRound}}]\n\n{{.Leader}} has chosen the following people:{{range .Members}}\n{{.Number}}. {{.Name}}{{if .Leader}} (leader){{end}}{{end}}\n\nFor all, check your PM. You have {{.Seconds}} seconds to approve/reject the choice. If you don't vote, it will count as a Reject.\n\nNo buttons? Type \".vote yes\" or \".vote no\".",
+		Samples: []interface{}{votingMessage{1, 1, "Alice", samplePlayers, 30}},
+	},
+	"start_voting_pm": {
+		Text:    "[Vote on team]\n[Mission #{{.Round}}, Leader #{{.VotingRound}}]\n\n{{.Leader}} has chosen the following people:{{range .Members}}\n{{.Number}}. {{.Name}}{{if .Leader}} (leader){{end}}{{end}}\n\nYou have {{.Seconds}} seconds to approve/reject the choice. If you don't vote, it will count as a Reject.",
+		Samples: []interface{}{votingMessage{1, 1, "Alice", samplePlayers, 30}},
+	},
+	"vote": {
+		Text:    "You vote {{if .Approve}}Approve{{else}}Reject{{end}}. You can always change this before the time runs out",
+		Samples: []interface{}{voteMessage{true}, voteMessage{false}},
+	},
+	"voting_done": {
+		Text: "Here are the voting result:{{range .Votes}}\n- {{.Name}} voted {{if .Approve}}Approve{{else}}Reject{{end}}{{else}}\n(no one votes){{end}}" +
+			"{{if and .Votes .NotVoted}}\n(The rest {{.NotVoted}} people did not vote){{end}}" +
+			"\n\n{{if .Majority}}Majority is reached. Mission will be executed.{{else if .LastRound}}Majority is not reached.{{else}}Majority is not reached. Moving on to the next leader.{{end}}",
+		Samples: []interface{}{
+			votingDoneMessage{[]voteView{{"Alice", true}, {"Bob", false}}, 3, true, false},
+			votingDoneMessage{nil, 5, false, true},
+			votingDoneMessage{},
+		},
+	},
+	"start_mission": {
+		Text:    "[Executing Mission #{{.Round}}]\n\nMembers:{{range $i, $name := .Members}}\n{{inc $i}}. {{$name}}{{end}}\n\nFor all members, check your PM to execute this mission. If you do not choose, it will be considered as a Success. You have {{.Seconds}} seconds.\n\nNo buttons? Type \".mission success\" or \".mission fail\".",
+		Samples: []interface{}{missionMessage{Round: 1, Members: sampleNames, Seconds: 30}},
+	},
+	"start_mission_pm": {
+		Text:    "[Executing Mission #{{.Round}}]\n\nMembers:{{range $i, $name := .Members}}\n{{inc $i}}. {{$name}}{{end}}\n\nChoose between success/fail. If you do not choose, it will be considered as a Success. You have {{.Seconds}} seconds.",
+		Samples: []interface{}{missionMessage{Round: 1, Members: sampleNames, Seconds: 30}},
+	},
+	"execute_mission": {
+		Text: "{{if .Success}}You choose Success{{else if .Resistance}}You cannot fail this mission as you are a Resistance{{else}}You choose Fail{{end}}",
+		Samples: []interface{}{
+			executeMissionMessage{true, false},
+			executeMissionMessage{false, true},
+			executeMissionMessage{false, false},
+		},
+	},
+	"mission_done": {
+		Text:    "[Executing Mission #{{.Round}}]\n\nMembers:{{range $i, $name := .Members}}\n{{inc $i}}. {{$name}}{{end}}\n\nOutcome: {{if .Success}}Success{{else}}Fail{{end}} ({{.NSuccess}} success, {{.NFail}} fail)",
+		Samples: []interface{}{missionMessage{1, sampleNames, 0, true, 2, 0}, missionMessage{1, sampleNames, 0, false, 1, 1}},
+	},
+	"spy_win": {
+		Text:    "{{if .Rejections}}Concensus are not reached after {{.Rejections}} times voting. {{end}}Spy won!",
+		Samples: []interface{}{gameOverMessage{5}, gameOverMessage{}},
+	},
+	"resistance_win": {
+		Text:    "Resistance won!",
+		Samples: []interface{}{gameOverMessage{}},
+	},
+	"start_warning": {
+		Text:    "Game will be started in {{.Seconds}} seconds",
+		Samples: []interface{}{secondsMessage{30}},
+	},
+	"time_warning": {
+		Text:    "You have {{.Seconds}} seconds left",
+		Samples: []interface{}{secondsMessage{15}},
+	},
+	"undeliverable": {
+		Text:    "I can't send private messages to {{.Name}}. {{.Name}}, please add me as friend so that I can send you your role and buttons.",
+		Samples: []interface{}{playerMessage{"Alice"}},
+	},
+	"suspend": {
+		Text:    "The bot is restarting. Your game will resume in a moment, right where you left it.",
+		Samples: []interface{}{nil},
+	},
+	"resume": {
+		Text: "The bot is back! Your game resumes" +
+			"{{if .Stage}} at mission #{{.Round}}, leader #{{.VotingRound}}. Timers have been restarted.{{else}}. Type \".join\" to join.{{end}}",
+		Samples: []interface{}{resumeMessage{"pick", 1, 2}, resumeMessage{}},
+	},
+	"history": {
+		Text: "[History]{{range .Proposals}}\n\nMission #{{.Round}}, Leader #{{.VotingRound}}: {{.Leader}} chose {{join .Team \", \"}}" +
+			"\nApprove: {{if .Approve}}{{join .Approve \", \"}}{{else}}-{{end}}" +
+			"\nReject: {{if .Reject}}{{join .Reject \", \"}}{{else}}-{{end}}{{if .NotVoted}} (did not vote: {{join .NotVoted \", \"}}){{end}}" +
+			"\n{{if .Approved}}Approved.{{if .MissionDone}} Mission {{if .MissionSuccess}}succeeded{{else}}failed{{end}} with {{.NFail}} fail card(s).{{end}}{{else}}Rejected.{{end}}" +
+			"{{else}}\n\nNo team has been voted on yet{{end}}",
+		Samples: []interface{}{historyMessage{sampleProposals}, historyMessage{}},
+	},
+	"report": {
+		Text: "[Game report]\n{{if .SpyWon}}Spies{{else}}Resistance{{end}} won. The spies were {{join .Spies \", \"}}.{{range .Rounds}}\n\nMission #{{.Round}}" +
+			"{{range .Proposals}}\n- Leader #{{.VotingRound}}, {{.Leader}} chose {{join .Team \", \"}}: {{if .Approved}}approved{{else}}rejected{{end}}" +
+			"\n  Approve: {{if .Approve}}{{join .Approve \", \"}}{{else}}-{{end}}\n  Reject: {{if .Reject}}{{join .Reject \", \"}}{{else}}-{{end}}{{if .NotVoted}} (did not vote: {{join .NotVoted \", \"}}){{end}}{{end}}" +
+			"{{if .Executed}}\n{{if .Success}}Succeeded{{else}}Failed{{end}}, {{if .Failed}}Fail played by {{join .Failed \", \"}}{{else}}no one played Fail{{end}}{{end}}{{end}}" +
+			"{{if .Highlights}}\n\nHighlights:{{range .Highlights}}\n- {{.}}{{end}}{{end}}",
+		Samples: []interface{}{sampleReport, reportMessage{
+			Spies: []string{"Alice"},
+			Rounds: []reportRound{{
+				Round:     1,
+				Proposals: []reportProposal{{1, "Bob", sampleNames, nil, nil, sampleNames, false}},
+			}},
+		}},
+	},
+	"no_report": {
+		Text:    "No game has finished here yet",
+		Samples: []interface{}{nil},
+	},
+}
+
+var defaultTemplates = mustLoadDefaultTemplates()
+
+func mustLoadDefaultTemplates() *Templates {
+	t := &Templates{templates: make(map[string]*template.Template)}
+	for name, spec := range templateSpecs {
+		tmpl, err := parseTemplate(name, spec.Text, spec)
+		if err != nil {
+			panic(err)
+		}
+		// Every branch of the built-in templates is checked
+		if unreached := unreachedBranches(name, spec.Text, spec.Samples); len(unreached) > 0 {
+			panic(fmt.Errorf("No sample of template %s reaches %s", name, strings.Join(unreached, ", ")))
+		}
+		t.templates[name] = tmpl
+	}
+	return t
+}
+
+// DefaultTemplates returns the built-in message templates.
+func DefaultTemplates() *Templates {
+	return defaultTemplates
+}
+
+// LoadTemplates loads message templates from dir, falling back to the
+// built-in default for every template that has no "<name>.tmpl" file. An
+// empty dir yields the defaults. All errors are collected so that an
+// operator can fix every broken template in one go.
+func LoadTemplates(dir string) (*Templates, error) {
+	if dir == "" {
+		return defaultTemplates, nil
+	}
+
+	t := &Templates{templates: make(map[string]*template.Template)}
+	var errs []string
+	for name, spec := range templateSpecs {
+		text, err := ioutil.ReadFile(filepath.Join(dir, name+".tmpl"))
+		if os.IsNotExist(err) {
+			t.templates[name] = defaultTemplates.templates[name]
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		tmpl, err := parseTemplate(name, string(text), spec)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if unreached := unreachedBranches(name, string(text), spec.Samples); len(unreached) > 0 {
+			logging.With("component", "template").Warnf("Could not check %s, no sample reaches it", strings.Join(unreached, ", "))
+		}
+		t.templates[name] = tmpl
+	}
+
+	// Unknown files are most likely typos, which would otherwise silently
+	// fall back to the default.
+	files, _ := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		if _, ok := templateSpecs[name]; !ok {
+			logging.With("component", "template").Warnf("Ignoring unknown template %s", file)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("invalid templates in %s:\n%s", dir, strings.Join(errs, "\n"))
+	}
+	return t, nil
+}
+
+func parseTemplate(name, text string, spec templateSpec) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, sample := range spec.Samples {
+		if err := tmpl.Execute(ioutil.Discard, sample); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// unreachedBranches returns the location of every if, range and with branch
+// of text that none of samples executes, which parseTemplate could not check.
+func unreachedBranches(name, text string, samples []interface{}) []string {
+	reached := make(map[int]bool)
+	funcs := template.FuncMap{"reach": func(i int) string {
+		reached[i] = true
+		return ""
+	}}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil
+	}
+
+	// Start every branch with {{reach <index>}}
+	var branches []string
+	var walk func(node parse.Node)
+	mark := func(node parse.Node, branch *parse.BranchNode) {
+		for _, list := range []*parse.ListNode{branch.List, branch.ElseList} {
+			if list == nil {
+				continue
+			}
+			walk(list)
+			location, _ := tmpl.ErrorContext(node)
+			if list == branch.ElseList {
+				location += " (else)"
+			}
+			reach := template.Must(template.New("").Funcs(funcs).Parse(fmt.Sprintf("{{reach %d}}", len(branches))))
+			list.Nodes = append([]parse.Node{reach.Tree.Root.Nodes[0]}, list.Nodes...)
+			branches = append(branches, location)
+		}
+	}
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.IfNode:
+			mark(n, &n.BranchNode)
+		case *parse.RangeNode:
+			mark(n, &n.BranchNode)
+		case *parse.WithNode:
+			mark(n, &n.BranchNode)
+		}
+	}
+	walk(tmpl.Tree.Root)
+
+	for _, sample := range samples {
+		tmpl.Execute(ioutil.Discard, sample)
+	}
+	var unreached []string
+	for i, location := range branches {
+		if !reached[i] {
+			unreached = append(unreached, location)
+		}
+	}
+	return unreached
+}
+
+// render executes the named template. A failing override falls back to the
+// built-in default, so a game is never left without a message.
+func (t *Templates) render(name string, data interface{}) string {
+	var buffer bytes.Buffer
+	if err := t.templates[name].Execute(&buffer, data); err != nil {
+		logging.With("component", "template").Errorf("Error rendering %s: %s", name, err.Error())
+		buffer.Reset()
+		defaultTemplates.templates[name].Execute(&buffer, data)
+	}
+	return buffer.String()
+}
@@ -0,0 +1,34 @@
+package resistance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnreachedBranches(t *testing.T) {
+	type data struct {
+		Spy   bool
+		Names []string
+	}
+	text := "{{if .Spy}}spy{{else}}resistance{{end}}{{range .Names}}{{.}}{{else}}no one{{end}}"
+
+	all := []interface{}{data{true, nil}, data{false, sampleNames}}
+	if unreached := unreachedBranches("test", text, all); len(unreached) != 0 {
+		t.Errorf("samples of every branch left %v", unreached)
+	}
+	want := []string{"test:1:5 (else)", "test:1:47 (else)"}
+	if unreached := unreachedBranches("test", text, []interface{}{data{true, sampleNames}}); !reflect.DeepEqual(unreached, want) {
+		t.Errorf("got %v, expected %v", unreached, want)
+	}
+}
+
+func TestGameOverMessages(t *testing.T) {
+	s := &Snapshot{VotingRound: 5, spyWonByRejection: true}
+	if got, want := DefaultTemplates().render("spy_win", newGameOverMessage(s)), "Concensus are not reached after 5 times voting. Spy won!"; got != want {
+		t.Errorf("spy win by rejection is %q, expected %q", got, want)
+	}
+	s.spyWonByRejection = false
+	if got, want := DefaultTemplates().render("spy_win", newGameOverMessage(s)), "Spy won!"; got != want {
+		t.Errorf("spy win is %q, expected %q", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+package resistance
+
+// PublicPlayer is what everyone in the group already knows about a player.
+// It never carries the player's role.
+type PublicPlayer struct {
+	Name   string `json:"name"`
+	Leader bool   `json:"leader,omitempty"`
+}
+
+type PublicMission struct {
+	Round   int            `json:"round"`
+	Members []PublicPlayer `json:"members"`
+	// Outcome is only filled once the mission is over; individual cards are
+	// never revealed, only the totals.
+	Done     bool `json:"done"`
+	Success  bool `json:"success,omitempty"`
+	NSuccess int  `json:"n_success,omitempty"`
+	NFail    int  `json:"n_fail,omitempty"`
+}
+
+// PublicProposal is a team that was voted on. Votes were shown in the group,
+// so they are public.
+type PublicProposal struct {
+	Round       int            `json:"round"`
+	VotingRound int            `json:"voting_round"`
+	Leader      PublicPlayer   `json:"leader"`
+	Team        []PublicPlayer `json:"team"`
+	Approve     []PublicPlayer `json:"approve"`
+	Reject      []PublicPlayer `json:"reject"`
+	NotVoted    []PublicPlayer `json:"not_voted"`
+	Approved    bool           `json:"approved"`
+}
+
+type PublicConfig struct {
+	NPlayers int   `json:"n_players"`
+	NSpies   int   `json:"n_spies"`
+	NMembers []int `json:"n_members"`
+	NFail    []int `json:"n_fail"`
+}
+
+// PublicGame is the view of a game that is safe to show to anyone, e.g. via
+// the HTTP API or a companion web page.
+type PublicGame struct {
+	ID          string           `json:"id"`
+	State       string           `json:"state"`
+	Players     []PublicPlayer   `json:"players"`
+	Round       int              `json:"round"`
+	VotingRound int              `json:"voting_round"`
+	Leader      *PublicPlayer    `json:"leader,omitempty"`
+	Team        []PublicPlayer   `json:"team,omitempty"`
+	Missions    []PublicMission  `json:"missions"`
+	Proposals   []PublicProposal `json:"proposals"`
+	Config      *PublicConfig    `json:"config,omitempty"`
+}
+
+func publicPlayers(players []*Player, leader *Player) []PublicPlayer {
+	list := []PublicPlayer{}
+	for _, player := range players {
+		list = append(list, PublicPlayer{
+			Name:   player.Name,
+			Leader: leader != nil && player.ID == leader.ID,
+		})
+	}
+	return list
+}
+
+// PublicView serializes the public state of the game.
+func (game *Snapshot) PublicView() *PublicGame {
+	view := &PublicGame{
+		ID:          game.ID,
+		State:       game.State.String(),
+		Round:       game.Round,
+		VotingRound: game.VotingRound,
+		Missions:    []PublicMission{},
+		Proposals:   []PublicProposal{},
+	}
+
+	var leader *Player
+	if game.LeaderIndex >= 0 && game.LeaderIndex < len(game.Players) {
+		leader = game.Players[game.LeaderIndex]
+		view.Leader = &PublicPlayer{Name: leader.Name, Leader: true}
+	}
+	view.Players = publicPlayers(game.Players, leader)
+
+	if game.State == STATE_PICK || game.State == STATE_VOTING {
+		view.Team = publicPlayers(game.GetPicks(), leader)
+	}
+
+	for _, mission := range game.Missions {
+		m := PublicMission{
+			Round:   mission.Round,
+			Members: publicPlayers(mission.Members, nil),
+			Done:    game.State != STATE_MISSION || mission != game.CurrentMission(),
+		}
+		if m.Done {
+			m.Success = mission.Success
+			m.NSuccess = mission.NSuccess()
+			m.NFail = mission.NFail()
+		}
+		view.Missions = append(view.Missions, m)
+	}
+
+	for _, proposal := range game.Proposals {
+		approve, reject, notVoted := proposal.Voters(game.Players)
+		view.Proposals = append(view.Proposals, PublicProposal{
+			Round:       proposal.Round,
+			VotingRound: proposal.VotingRound,
+			Leader:      PublicPlayer{Name: proposal.Leader.Name, Leader: true},
+			Team:        publicPlayers(proposal.Team, proposal.Leader),
+			Approve:     publicPlayers(approve, nil),
+			Reject:      publicPlayers(reject, nil),
+			NotVoted:    publicPlayers(notVoted, nil),
+			Approved:    proposal.Approved,
+		})
+	}
+
+	if c := game.Config; c != nil {
+		view.Config = &PublicConfig{
+			NPlayers: c.NPlayers,
+			NSpies:   c.NSpies,
+			NMembers: c.NMembers,
+			NFail:    c.NFail,
+		}
+	}
+	return view
+}
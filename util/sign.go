@@ -0,0 +1,21 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Sign returns a hex-encoded HMAC-SHA256 of parts, keyed by secret.
+func Sign(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks in constant time that signature was produced by Sign with
+// the same secret and parts.
+func Verify(secret, signature string, parts ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, parts...)))
+}